@@ -1,13 +1,89 @@
 package v1alpha1
 
 import (
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
+// SettingsSpec defines the desired state of the Settings
+type SettingsSpec struct {
+	// Profile is the name of the settings profile, defined in the controller configuration,
+	// to apply to the workspace. It takes precedence over the profile annotation of the APIBinding.
+	// The default settings are applied when no profile is specified.
+	// +optional
+	Profile string `json:"profile,omitempty"`
+}
+
+// QuotaStatus reports the hard limits and the usage of a ResourceQuota managed in the workspace.
+type QuotaStatus struct {
+	// Name of the ResourceQuota
+	Name string `json:"name"`
+
+	// Hard is the set of enforced hard limits for each named resource.
+	// +optional
+	Hard corev1.ResourceList `json:"hard,omitempty"`
+
+	// Used is the current observed total usage of the resource in the workspace.
+	// +optional
+	Used corev1.ResourceList `json:"used,omitempty"`
+
+	// UsedPercentage is the usage of each resource as a percentage of its hard limit.
+	// Resources with a hard limit of 0 are not reported.
+	// +optional
+	UsedPercentage map[corev1.ResourceName]int64 `json:"usedPercentage,omitempty"`
+}
+
+// ManagedResource identifies a resource managed by the controller in the workspace.
+type ManagedResource struct {
+	// Group of the resource, empty for the core group
+	// +optional
+	Group string `json:"group,omitempty"`
+
+	// Kind of the resource
+	Kind string `json:"kind"`
+
+	// Namespace of the resource, empty for cluster scoped resources
+	// +optional
+	Namespace string `json:"namespace,omitempty"`
+
+	// Name of the resource
+	Name string `json:"name"`
+
+	// Hash of the desired state last applied
+	// +optional
+	Hash string `json:"hash,omitempty"`
+
+	// LastSyncTime is the last time the resource was created or updated by the controller.
+	// +optional
+	LastSyncTime *metav1.Time `json:"lastSyncTime,omitempty"`
+}
+
 // SettingsStatus defines the observed state of the Settings
 type SettingsStatus struct {
 	// Conditions represent the latest available observations of an object's state
 	Conditions []metav1.Condition `json:"conditions,omitempty" patchStrategy:"merge" patchMergeKey:"type"`
+
+	// Quotas mirrors the status of the ResourceQuotas managed in the workspace.
+	// +optional
+	Quotas []QuotaStatus `json:"quotas,omitempty"`
+
+	// ManagedResources is the inventory of the resources managed by the controller in the workspace.
+	// Resources, which are not part of the desired state anymore, are pruned.
+	// +optional
+	ManagedResources []ManagedResource `json:"managedResources,omitempty"`
+
+	// ObservedGeneration is the generation of the Settings last applied successfully.
+	// +optional
+	ObservedGeneration int64 `json:"observedGeneration,omitempty"`
+
+	// ConfigHash is the hash of the controller configuration last applied successfully to the workspace.
+	// It allows tracking the rollout of a new configuration.
+	// +optional
+	ConfigHash string `json:"configHash,omitempty"`
+
+	// DesiredStateHash is the hash of the desired state of the managed resources last applied successfully.
+	// +optional
+	DesiredStateHash string `json:"desiredStateHash,omitempty"`
 }
 
 // +kubebuilder:object:root=true
@@ -19,6 +95,7 @@ type Settings struct {
 	metav1.TypeMeta   `json:",inline"`
 	metav1.ObjectMeta `json:"metadata,omitempty"`
 
+	Spec   SettingsSpec   `json:"spec,omitempty"`
 	Status SettingsStatus `json:"status,omitempty"`
 }
 
@@ -9,18 +9,144 @@ import (
 
 // NOTE: json tags are required. Any new fields you add must have json tags for the fields to be serialized.
 
+// NamedNetworkPolicy is a NetworkPolicy managed by the controller.
+type NamedNetworkPolicy struct {
+	// Name of the NetworkPolicy.
+	Name string `json:"name"`
+
+	// Specification of the desired behavior for this NetworkPolicy.
+	// +optional
+	Spec netv1.NetworkPolicySpec `json:"spec,omitempty"`
+}
+
 type SettingsNetPolConfig struct {
 	// Specification of the desired behavior for this NetworkPolicy.
+	// It is only used when no policies are specified and is created under the "hermetic-build" name.
 	// +optional
 	Spec netv1.NetworkPolicySpec `json:"spec,omitempty"`
+
+	// Policies are the NetworkPolicies to create, for instance default-deny, allow-dns, etc.
+	// NetworkPolicies previously created by the controller, which are not part of the list anymore, get deleted.
+	// +optional
+	Policies []NamedNetworkPolicy `json:"policies,omitempty"`
+}
+
+// NamedResourceQuota is a ResourceQuota managed by the controller.
+type NamedResourceQuota struct {
+	// Name of the ResourceQuota.
+	Name string `json:"name"`
+
+	// Defines the desired quota, including its scopes and scope selector.
+	// +optional
+	Spec corev1.ResourceQuotaSpec `json:"spec,omitempty"`
 }
 
 type SettingsQuotaConfig struct {
 	// Defines the desired quota.
+	// It is only used when no quotas are specified and is created under the "settings" name.
 	// +optional
 	Spec corev1.ResourceQuotaSpec `json:"spec,omitempty"`
+
+	// Quotas are the ResourceQuotas to create, for instance one for BestEffort pods,
+	// one scoped by PriorityClass and one for object counts.
+	// ResourceQuotas previously created by the controller, which are not part of the list anymore, get deleted.
+	// +optional
+	Quotas []NamedResourceQuota `json:"quotas,omitempty"`
+}
+
+type SettingsLimitRangeConfig struct {
+	// Defines the desired limits, for instance the default requests and limits of containers,
+	// so that pods without requests are not rejected by compute quotas.
+	// No LimitRange is created when no limit is specified.
+	// +optional
+	Spec corev1.LimitRangeSpec `json:"spec,omitempty"`
+}
+
+// SettingsProfile is a named set of settings, which can be selected per workspace
+// instead of the default settings. The sections not set in the profile are inherited from the default settings.
+type SettingsProfile struct {
+	// Name of the profile, for instance "small", "medium" or "enterprise".
+	Name string `json:"name"`
+
+	NetPolConfig     SettingsNetPolConfig     `json:"networkPolicyConfig,omitempty"`
+	QuotaConfig      SettingsQuotaConfig      `json:"quotaConfig,omitempty"`
+	LimitRangeConfig SettingsLimitRangeConfig `json:"limitRangeConfig,omitempty"`
+}
+
+// SettingsAllowedProfiles restricts the profiles, which can be selected in a single workspace.
+type SettingsAllowedProfiles struct {
+	// Workspace is the logical cluster of the workspace, root:org:ws for instance.
+	Workspace string `json:"workspace"`
+
+	// Profiles are the names of the profiles, which can be selected in the workspace.
+	// The default settings can always be used.
+	// +optional
+	Profiles []string `json:"profiles,omitempty"`
+}
+
+// SettingsQuotaOverride raises or lowers the quota hard limits of a single workspace.
+type SettingsQuotaOverride struct {
+	// Workspace is the logical cluster of the workspace, root:org:ws for instance.
+	Workspace string `json:"workspace"`
+
+	// Hard is merged over the hard limits of the quotas. A resource listed here replaces the default limit
+	// in every quota defining it or is added to the first quota if no quota defines it.
+	Hard corev1.ResourceList `json:"hard"`
+}
+
+// SettingsQuotaThresholds are the usage percentages of the quota hard limits,
+// above which the quota pressure of a workspace is reported.
+type SettingsQuotaThresholds struct {
+	// Warning is the usage percentage above which a quota is nearly exhausted. It defaults to 80.
+	// +optional
+	Warning int64 `json:"warning,omitempty"`
+
+	// Critical is the usage percentage above which a quota is critically exhausted. It defaults to 95.
+	// +optional
+	Critical int64 `json:"critical,omitempty"`
+}
+
+// SettingsRolloutStrategy defines how a new configuration is rolled out to the workspaces.
+// The canary workspaces get it first. The other workspaces get it, according to the percentage,
+// once all the canaries are healthy with it. The workspaces not selected yet keep the resources
+// applied with the previous configuration.
+type SettingsRolloutStrategy struct {
+	// CanarySelector selects the canary workspaces through the labels of their APIBinding.
+	// +optional
+	CanarySelector *metav1.LabelSelector `json:"canarySelector,omitempty"`
+
+	// Percentage of the other workspaces, which get the new configuration once the canaries are healthy.
+	// It is increased up to 100 to complete the rollout. It defaults to 100.
+	// +optional
+	Percentage *int32 `json:"percentage,omitempty"`
+
+	// Paused stops the rollout: no further workspace gets the new configuration till it is resumed.
+	// +optional
+	Paused bool `json:"paused,omitempty"`
 }
 
+// CleanupPolicy defines what happens to the resources managed in a workspace when its APIBinding is deleted.
+type CleanupPolicy string
+
+const (
+	// CleanupPolicyDelete deletes the namespace, the quotas, the network policies and the limit range managed by the controller.
+	CleanupPolicyDelete CleanupPolicy = "Delete"
+	// CleanupPolicyOrphan leaves the managed resources in place and removes their references to the APIBinding.
+	CleanupPolicyOrphan CleanupPolicy = "Orphan"
+)
+
+// NamespacePolicy defines what happens when the namespace of the managed resources already exists in a workspace
+// and has not been created by the controller.
+type NamespacePolicy string
+
+const (
+	// NamespacePolicyAdopt sets the APIBinding as the controller of the namespace. The namespace is then handled
+	// as if it had been created by the controller, it gets deleted with the Delete cleanup policy for instance.
+	NamespacePolicyAdopt NamespacePolicy = "Adopt"
+	// NamespacePolicyRefuse leaves the namespace untouched and skips the workspace.
+	NamespacePolicyRefuse NamespacePolicy = "Refuse"
+)
+
 //+kubebuilder:object:root=true
 
 // SettingsConfig is the Schema for the settingsconfigs API
@@ -41,8 +167,50 @@ type SettingsConfig struct {
 	// +optional
 	Namespace string `json:"namespace,omitempty"`
 
-	NetPolConfig SettingsNetPolConfig `json:"networkPolicyConfig,omitempty"`
-	QuotaConfig  SettingsQuotaConfig  `json:"quotaConfig,omitempty"`
+	NetPolConfig     SettingsNetPolConfig     `json:"networkPolicyConfig,omitempty"`
+	QuotaConfig      SettingsQuotaConfig      `json:"quotaConfig,omitempty"`
+	LimitRangeConfig SettingsLimitRangeConfig `json:"limitRangeConfig,omitempty"`
+
+	// CleanupPolicy defines whether the managed resources are deleted or orphaned when the workspace
+	// gets unbound. It defaults to Delete.
+	// +optional
+	CleanupPolicy CleanupPolicy `json:"cleanupPolicy,omitempty"`
+
+	// NamespacePolicy defines whether a namespace, which already exists in the workspace and has not been created
+	// by the controller, is adopted or whether the workspace is skipped. It defaults to Refuse.
+	// A namespace controlled by another owner is never adopted.
+	// +optional
+	NamespacePolicy NamespacePolicy `json:"namespacePolicy,omitempty"`
+
+	// Profiles are named alternatives to the default network policy, quota and limit range configuration.
+	// A profile is selected through the Settings spec or through an annotation on the APIBinding.
+	// +optional
+	Profiles []SettingsProfile `json:"profiles,omitempty"`
+
+	// AllowedProfiles restrict the profiles, which can be selected in some workspaces, so that a free-tier
+	// workspace cannot select a paid profile for instance. Any profile can be selected in the other workspaces.
+	// +optional
+	AllowedProfiles []SettingsAllowedProfiles `json:"allowedProfiles,omitempty"`
+
+	// MaxQuotaOverrides are the maximum values, which can be set through the quota overrides.
+	// Only the listed resources can be overridden when it is specified.
+	// +optional
+	MaxQuotaOverrides corev1.ResourceList `json:"maxQuotaOverrides,omitempty"`
+
+	// QuotaOverrides are the quota hard limits specific to some workspaces. They are part of the controller
+	// configuration so that they can only be set by the platform administrator, not by the workspace owners.
+	// They are applied right away, regardless of the rollout strategy.
+	// +optional
+	QuotaOverrides []SettingsQuotaOverride `json:"quotaOverrides,omitempty"`
+
+	// QuotaThresholds set when the QuotaPressure condition of the Settings is raised.
+	// +optional
+	QuotaThresholds SettingsQuotaThresholds `json:"quotaThresholds,omitempty"`
+
+	// Rollout is the strategy used for rolling out a new configuration.
+	// A new configuration is applied to all the workspaces at once when it is not specified.
+	// +optional
+	Rollout *SettingsRolloutStrategy `json:"rollout,omitempty"`
 }
 
 //+kubebuilder:object:root=true
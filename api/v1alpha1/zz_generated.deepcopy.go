@@ -6,15 +6,104 @@
 package v1alpha1
 
 import (
-	"k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	runtime "k8s.io/apimachinery/pkg/runtime"
 )
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *ManagedResource) DeepCopyInto(out *ManagedResource) {
+	*out = *in
+	if in.LastSyncTime != nil {
+		in, out := &in.LastSyncTime, &out.LastSyncTime
+		*out = (*in).DeepCopy()
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new ManagedResource.
+func (in *ManagedResource) DeepCopy() *ManagedResource {
+	if in == nil {
+		return nil
+	}
+	out := new(ManagedResource)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NamedNetworkPolicy) DeepCopyInto(out *NamedNetworkPolicy) {
+	*out = *in
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NamedNetworkPolicy.
+func (in *NamedNetworkPolicy) DeepCopy() *NamedNetworkPolicy {
+	if in == nil {
+		return nil
+	}
+	out := new(NamedNetworkPolicy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *NamedResourceQuota) DeepCopyInto(out *NamedResourceQuota) {
+	*out = *in
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new NamedResourceQuota.
+func (in *NamedResourceQuota) DeepCopy() *NamedResourceQuota {
+	if in == nil {
+		return nil
+	}
+	out := new(NamedResourceQuota)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *QuotaStatus) DeepCopyInto(out *QuotaStatus) {
+	*out = *in
+	if in.Hard != nil {
+		in, out := &in.Hard, &out.Hard
+		*out = make(v1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.Used != nil {
+		in, out := &in.Used, &out.Used
+		*out = make(v1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.UsedPercentage != nil {
+		in, out := &in.UsedPercentage, &out.UsedPercentage
+		*out = make(map[v1.ResourceName]int64, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new QuotaStatus.
+func (in *QuotaStatus) DeepCopy() *QuotaStatus {
+	if in == nil {
+		return nil
+	}
+	out := new(QuotaStatus)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *Settings) DeepCopyInto(out *Settings) {
 	*out = *in
 	out.TypeMeta = in.TypeMeta
 	in.ObjectMeta.DeepCopyInto(&out.ObjectMeta)
+	out.Spec = in.Spec
 	in.Status.DeepCopyInto(&out.Status)
 }
 
@@ -36,6 +125,26 @@ func (in *Settings) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SettingsAllowedProfiles) DeepCopyInto(out *SettingsAllowedProfiles) {
+	*out = *in
+	if in.Profiles != nil {
+		in, out := &in.Profiles, &out.Profiles
+		*out = make([]string, len(*in))
+		copy(*out, *in)
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SettingsAllowedProfiles.
+func (in *SettingsAllowedProfiles) DeepCopy() *SettingsAllowedProfiles {
+	if in == nil {
+		return nil
+	}
+	out := new(SettingsAllowedProfiles)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SettingsConfig) DeepCopyInto(out *SettingsConfig) {
 	*out = *in
@@ -43,6 +152,41 @@ func (in *SettingsConfig) DeepCopyInto(out *SettingsConfig) {
 	in.ControllerManagerConfigurationSpec.DeepCopyInto(&out.ControllerManagerConfigurationSpec)
 	in.NetPolConfig.DeepCopyInto(&out.NetPolConfig)
 	in.QuotaConfig.DeepCopyInto(&out.QuotaConfig)
+	in.LimitRangeConfig.DeepCopyInto(&out.LimitRangeConfig)
+	if in.Profiles != nil {
+		in, out := &in.Profiles, &out.Profiles
+		*out = make([]SettingsProfile, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.AllowedProfiles != nil {
+		in, out := &in.AllowedProfiles, &out.AllowedProfiles
+		*out = make([]SettingsAllowedProfiles, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.MaxQuotaOverrides != nil {
+		in, out := &in.MaxQuotaOverrides, &out.MaxQuotaOverrides
+		*out = make(v1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+	if in.QuotaOverrides != nil {
+		in, out := &in.QuotaOverrides, &out.QuotaOverrides
+		*out = make([]SettingsQuotaOverride, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	out.QuotaThresholds = in.QuotaThresholds
+	if in.Rollout != nil {
+		in, out := &in.Rollout, &out.Rollout
+		*out = new(SettingsRolloutStrategy)
+		(*in).DeepCopyInto(*out)
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SettingsConfig.
@@ -63,6 +207,22 @@ func (in *SettingsConfig) DeepCopyObject() runtime.Object {
 	return nil
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SettingsLimitRangeConfig) DeepCopyInto(out *SettingsLimitRangeConfig) {
+	*out = *in
+	in.Spec.DeepCopyInto(&out.Spec)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SettingsLimitRangeConfig.
+func (in *SettingsLimitRangeConfig) DeepCopy() *SettingsLimitRangeConfig {
+	if in == nil {
+		return nil
+	}
+	out := new(SettingsLimitRangeConfig)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SettingsList) DeepCopyInto(out *SettingsList) {
 	*out = *in
@@ -99,6 +259,13 @@ func (in *SettingsList) DeepCopyObject() runtime.Object {
 func (in *SettingsNetPolConfig) DeepCopyInto(out *SettingsNetPolConfig) {
 	*out = *in
 	in.Spec.DeepCopyInto(&out.Spec)
+	if in.Policies != nil {
+		in, out := &in.Policies, &out.Policies
+		*out = make([]NamedNetworkPolicy, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SettingsNetPolConfig.
@@ -111,10 +278,35 @@ func (in *SettingsNetPolConfig) DeepCopy() *SettingsNetPolConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SettingsProfile) DeepCopyInto(out *SettingsProfile) {
+	*out = *in
+	in.NetPolConfig.DeepCopyInto(&out.NetPolConfig)
+	in.QuotaConfig.DeepCopyInto(&out.QuotaConfig)
+	in.LimitRangeConfig.DeepCopyInto(&out.LimitRangeConfig)
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SettingsProfile.
+func (in *SettingsProfile) DeepCopy() *SettingsProfile {
+	if in == nil {
+		return nil
+	}
+	out := new(SettingsProfile)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SettingsQuotaConfig) DeepCopyInto(out *SettingsQuotaConfig) {
 	*out = *in
 	in.Spec.DeepCopyInto(&out.Spec)
+	if in.Quotas != nil {
+		in, out := &in.Quotas, &out.Quotas
+		*out = make([]NamedResourceQuota, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
 }
 
 // DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SettingsQuotaConfig.
@@ -127,12 +319,103 @@ func (in *SettingsQuotaConfig) DeepCopy() *SettingsQuotaConfig {
 	return out
 }
 
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SettingsQuotaOverride) DeepCopyInto(out *SettingsQuotaOverride) {
+	*out = *in
+	if in.Hard != nil {
+		in, out := &in.Hard, &out.Hard
+		*out = make(v1.ResourceList, len(*in))
+		for key, val := range *in {
+			(*out)[key] = val.DeepCopy()
+		}
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SettingsQuotaOverride.
+func (in *SettingsQuotaOverride) DeepCopy() *SettingsQuotaOverride {
+	if in == nil {
+		return nil
+	}
+	out := new(SettingsQuotaOverride)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SettingsQuotaThresholds) DeepCopyInto(out *SettingsQuotaThresholds) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SettingsQuotaThresholds.
+func (in *SettingsQuotaThresholds) DeepCopy() *SettingsQuotaThresholds {
+	if in == nil {
+		return nil
+	}
+	out := new(SettingsQuotaThresholds)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SettingsRolloutStrategy) DeepCopyInto(out *SettingsRolloutStrategy) {
+	*out = *in
+	if in.CanarySelector != nil {
+		in, out := &in.CanarySelector, &out.CanarySelector
+		*out = new(metav1.LabelSelector)
+		(*in).DeepCopyInto(*out)
+	}
+	if in.Percentage != nil {
+		in, out := &in.Percentage, &out.Percentage
+		*out = new(int32)
+		**out = **in
+	}
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SettingsRolloutStrategy.
+func (in *SettingsRolloutStrategy) DeepCopy() *SettingsRolloutStrategy {
+	if in == nil {
+		return nil
+	}
+	out := new(SettingsRolloutStrategy)
+	in.DeepCopyInto(out)
+	return out
+}
+
+// DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
+func (in *SettingsSpec) DeepCopyInto(out *SettingsSpec) {
+	*out = *in
+}
+
+// DeepCopy is an autogenerated deepcopy function, copying the receiver, creating a new SettingsSpec.
+func (in *SettingsSpec) DeepCopy() *SettingsSpec {
+	if in == nil {
+		return nil
+	}
+	out := new(SettingsSpec)
+	in.DeepCopyInto(out)
+	return out
+}
+
 // DeepCopyInto is an autogenerated deepcopy function, copying the receiver, writing into out. in must be non-nil.
 func (in *SettingsStatus) DeepCopyInto(out *SettingsStatus) {
 	*out = *in
 	if in.Conditions != nil {
 		in, out := &in.Conditions, &out.Conditions
-		*out = make([]v1.Condition, len(*in))
+		*out = make([]metav1.Condition, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.Quotas != nil {
+		in, out := &in.Quotas, &out.Quotas
+		*out = make([]QuotaStatus, len(*in))
+		for i := range *in {
+			(*in)[i].DeepCopyInto(&(*out)[i])
+		}
+	}
+	if in.ManagedResources != nil {
+		in, out := &in.ManagedResources, &out.ManagedResources
+		*out = make([]ManagedResource, len(*in))
 		for i := range *in {
 			(*in)[i].DeepCopyInto(&(*out)[i])
 		}
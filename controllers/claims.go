@@ -0,0 +1,61 @@
+package controllers
+
+import (
+	"strings"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// Permission claims of the APIExport, which the controller relies on.
+var (
+	apiBindingsClaim     = apisv1alpha1.GroupResource{Group: "apis.kcp.dev", Resource: "apibindings"}
+	networkPoliciesClaim = apisv1alpha1.GroupResource{Group: "networking.k8s.io", Resource: "networkpolicies"}
+	resourceQuotasClaim  = apisv1alpha1.GroupResource{Resource: "resourcequotas"}
+	namespacesClaim      = apisv1alpha1.GroupResource{Resource: "namespaces"}
+	limitRangesClaim     = apisv1alpha1.GroupResource{Resource: "limitranges"}
+	eventsClaim          = apisv1alpha1.GroupResource{Resource: "events"}
+)
+
+// requiredClaims returns the permission claims used by the controller.
+func requiredClaims() []apisv1alpha1.GroupResource {
+	return []apisv1alpha1.GroupResource{
+		apiBindingsClaim,
+		networkPoliciesClaim,
+		resourceQuotasClaim,
+		namespacesClaim,
+		limitRangesClaim,
+		eventsClaim,
+	}
+}
+
+// acceptedClaims indexes the permission claims accepted by the workspace.
+type acceptedClaims map[apisv1alpha1.GroupResource]bool
+
+// acceptedPermissionClaims returns the permission claims accepted in the APIBinding.
+// The resources whose claims have not been accepted are not accessible to the controller.
+func acceptedPermissionClaims(ab *apisv1alpha1.APIBinding) acceptedClaims {
+	claims := acceptedClaims{}
+	for _, claim := range ab.Spec.AcceptedPermissionClaims {
+		claims[claim.GroupResource] = true
+	}
+	return claims
+}
+
+// missing returns the names of the required claims, which have not been accepted.
+func (c acceptedClaims) missing() []string {
+	var names []string
+	for _, claim := range requiredClaims() {
+		if !c[claim] {
+			names = append(names, claimName(claim))
+		}
+	}
+	return names
+}
+
+// claimName returns the name of the claimed resource qualified by its group, networkpolicies.networking.k8s.io for instance.
+func claimName(claim apisv1alpha1.GroupResource) string {
+	if claim.Group == "" {
+		return claim.Resource
+	}
+	return strings.Join([]string{claim.Resource, claim.Group}, ".")
+}
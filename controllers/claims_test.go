@@ -0,0 +1,121 @@
+package controllers
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/yaml"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+func TestRequiredClaims(t *testing.T) {
+	// The claims required by the controller are the ones of the APIExport manifest.
+	f, err := os.Open("../config/kcp/apiexport.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var export apisv1alpha1.APIExport
+	if err := yaml.NewYAMLOrJSONDecoder(f, 4096).Decode(&export); err != nil {
+		t.Fatal(err)
+	}
+	var claims []apisv1alpha1.GroupResource
+	for _, claim := range export.Spec.PermissionClaims {
+		claims = append(claims, claim.GroupResource)
+	}
+	if !reflect.DeepEqual(claims, requiredClaims()) {
+		t.Errorf("requiredClaims() = %v, expected the claims of the APIExport %v", requiredClaims(), claims)
+	}
+}
+
+func TestAcceptedPermissionClaims(t *testing.T) {
+	tests := []struct {
+		name     string
+		accepted []apisv1alpha1.GroupResource
+		missing  []string
+	}{
+		{name: "all claims accepted", accepted: requiredClaims()},
+		{
+			name:     "some claims accepted",
+			accepted: []apisv1alpha1.GroupResource{apiBindingsClaim, namespacesClaim, resourceQuotasClaim},
+			missing:  []string{"networkpolicies.networking.k8s.io", "limitranges", "events"},
+		},
+		{
+			name:    "no claim accepted",
+			missing: []string{"apibindings.apis.kcp.dev", "networkpolicies.networking.k8s.io", "resourcequotas", "namespaces", "limitranges", "events"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ab := newTestAPIBinding()
+			for _, claim := range tt.accepted {
+				ab.Spec.AcceptedPermissionClaims = append(ab.Spec.AcceptedPermissionClaims, apisv1alpha1.PermissionClaim{GroupResource: claim})
+			}
+			claims := acceptedPermissionClaims(ab)
+			for _, claim := range tt.accepted {
+				if !claims[claim] {
+					t.Errorf("claim %s is not accepted", claimName(claim))
+				}
+			}
+			if missing := claims.missing(); !reflect.DeepEqual(missing, tt.missing) {
+				t.Errorf("missing() = %v, expected %v", missing, tt.missing)
+			}
+		})
+	}
+}
+
+func TestReconcileClaimNotAccepted(t *testing.T) {
+	config := managedConfig("100")
+	rt := newReconcileTest(t, config, []apisv1alpha1.GroupResource{apiBindingsClaim, namespacesClaim, networkPoliciesClaim, limitRangesClaim, eventsClaim})
+
+	_, s, err := rt.reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	rt.expectCondition(s, "PermissionClaimsAccepted", metav1.ConditionFalse, "ClaimsNotAccepted")
+	rt.expectCondition(s, "QuotasReady", metav1.ConditionFalse, "ClaimNotAccepted")
+	rt.expectCondition(s, "NetworkPoliciesReady", metav1.ConditionTrue, "NetworkPoliciesCreated")
+	if err := rt.r.Get(context.Background(), types.NamespacedName{Namespace: config.Namespace, Name: QtName}, &corev1.ResourceQuota{}); !errors.IsNotFound(err) {
+		t.Errorf("a quota has been created without the claim being accepted: %v", err)
+	}
+}
+
+func TestReconcileNamespaceClaimNotAccepted(t *testing.T) {
+	config := managedConfig("100")
+	rt := newReconcileTest(t, config, []apisv1alpha1.GroupResource{apiBindingsClaim, networkPoliciesClaim, resourceQuotasClaim, limitRangesClaim, eventsClaim})
+
+	// The namespace is expected to be created by the workspace owner.
+	result, s, err := rt.reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	rt.expectCondition(s, "NamespaceReady", metav1.ConditionFalse, "ClaimNotAccepted")
+	rt.expectCondition(s, "QuotasReady", metav1.ConditionFalse, "NamespaceNotReady")
+	rt.expectCondition(s, "NetworkPoliciesReady", metav1.ConditionFalse, "NamespaceNotReady")
+	if result.RequeueAfter != NamespaceRequeuePeriod {
+		t.Errorf("the workspace is requeued after %v, expected %v", result.RequeueAfter, NamespaceRequeuePeriod)
+	}
+
+	// The resources are applied once the namespace has been created.
+	if err := rt.r.Create(context.Background(), &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: config.Namespace}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, s, err = rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	rt.expectCondition(s, "NamespaceReady", metav1.ConditionFalse, "ClaimNotAccepted")
+	rt.expectCondition(s, "QuotasReady", metav1.ConditionTrue, "QuotasCreated")
+	rt.get(config.Namespace, QtName, &corev1.ResourceQuota{})
+	var ns corev1.Namespace
+	rt.get("", config.Namespace, &ns)
+	if len(ns.GetOwnerReferences()) > 0 {
+		t.Errorf("the namespace of the workspace owner has been adopted: %+v", ns.GetOwnerReferences())
+	}
+}
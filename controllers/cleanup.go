@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	cutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// CleanupFinalizer is set on the APIBinding so that the managed resources are deterministically
+// cleaned up when the workspace gets unbound. Owner references from the APIBinding are not
+// guaranteed to trigger garbage collection across the virtual workspace.
+const CleanupFinalizer = "configuration.pipeline-service.io/cleanup"
+
+// cleanup deletes or orphans, depending on the configured policy, the resources managed for the APIBinding
+// and removes the finalizer once done.
+// Resources whose permission claims have not been accepted are left untouched as they are not accessible.
+func (r *SettingsReconciler) cleanup(ctx context.Context, ab *apisv1alpha1.APIBinding, ctrlConfig *settingsv1alpha1.SettingsConfig, claims acceptedClaims) error {
+	logger := ctrl.LoggerFrom(ctx)
+
+	if !cutil.ContainsFinalizer(ab, CleanupFinalizer) {
+		return nil
+	}
+
+	resources, err := r.cleanupInventory(ctx, ab, ctrlConfig.Namespace, claims)
+	if err != nil {
+		return err
+	}
+	switch ctrlConfig.CleanupPolicy {
+	case settingsv1alpha1.CleanupPolicyOrphan:
+		logger.V(1).Info("Orphaning the managed resources", "count", len(resources))
+	default:
+		logger.V(1).Info("Deleting the managed resources", "count", len(resources))
+	}
+	if err := r.cleanupResources(ctx, ab, resources, ctrlConfig.CleanupPolicy); err != nil {
+		return err
+	}
+
+	patch := client.MergeFrom(ab.DeepCopy())
+	cutil.RemoveFinalizer(ab, CleanupFinalizer)
+	if err := r.Patch(ctx, ab, patch); err != nil {
+		return fmt.Errorf("unable to remove the finalizer: %w", err)
+	}
+	logger.V(1).Info("Managed resources cleaned up")
+	return nil
+}
+
+// cleanupInventory returns the resources to clean up: the inventory recorded in the Settings status,
+// so that resources left in a previously configured namespace are cleaned up as well, or the resources
+// controlled by the APIBinding in the configured namespace when no inventory has been recorded.
+// The resources, whose permission claims have not been accepted, are left out as they are not accessible.
+func (r *SettingsReconciler) cleanupInventory(ctx context.Context, ab *apisv1alpha1.APIBinding, namespace string, claims acceptedClaims) ([]settingsv1alpha1.ManagedResource, error) {
+	var s settingsv1alpha1.Settings
+	if err := r.Get(ctx, types.NamespacedName{Name: SettingName}, &s); err != nil && !errors.IsNotFound(err) {
+		return nil, fmt.Errorf("unable to get the Settings: %w", err)
+	}
+	resources := s.Status.ManagedResources
+	if len(resources) == 0 {
+		var err error
+		if resources, err = r.discoverManagedResources(ctx, ab, namespace, claims); err != nil {
+			return nil, err
+		}
+	}
+
+	var accessible []settingsv1alpha1.ManagedResource
+	for _, res := range resources {
+		if claims[kindClaims[res.Kind]] {
+			accessible = append(accessible, res)
+		}
+	}
+	return accessible, nil
+}
+
+// cleanupResources deletes or orphans, depending on the policy, the resources still controlled by the APIBinding.
+// Deleting a namespace cascades to the objects inside it.
+func (r *SettingsReconciler) cleanupResources(ctx context.Context, ab *apisv1alpha1.APIBinding, resources []settingsv1alpha1.ManagedResource, policy settingsv1alpha1.CleanupPolicy) error {
+	var errs []error
+	for _, res := range resources {
+		obj, err := r.newObject(res.Group, res.Kind)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := r.Get(ctx, types.NamespacedName{Namespace: res.Namespace, Name: res.Name}, obj); err != nil {
+			if !errors.IsNotFound(err) {
+				errs = append(errs, fmt.Errorf("unable to get %q: %w", res.Name, err))
+			}
+			continue
+		}
+		if !metav1.IsControlledBy(obj, ab) {
+			continue
+		}
+		if policy == settingsv1alpha1.CleanupPolicyOrphan {
+			if err := r.removeOwnerReference(ctx, ab, obj); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		if err := r.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			errs = append(errs, fmt.Errorf("unable to delete %q: %w", res.Name, err))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// removeOwnerReference patches the object to remove the owner reference to the APIBinding, if it has one.
+func (r *SettingsReconciler) removeOwnerReference(ctx context.Context, ab *apisv1alpha1.APIBinding, obj client.Object) error {
+	var refs []metav1.OwnerReference
+	for _, ref := range obj.GetOwnerReferences() {
+		if ref.UID != ab.GetUID() {
+			refs = append(refs, ref)
+		}
+	}
+	if len(refs) == len(obj.GetOwnerReferences()) {
+		return nil
+	}
+
+	patch := client.MergeFrom(obj.DeepCopyObject().(client.Object))
+	obj.SetOwnerReferences(refs)
+	if err := r.Patch(ctx, obj, patch); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("unable to orphan %q: %w", obj.GetName(), err)
+	}
+	return nil
+}
+
+// managedLists returns the list types of the objects managed by the controller inside the namespace,
+// whose permission claims have been accepted.
+func managedLists(claims acceptedClaims) []client.ObjectList {
+	var lists []client.ObjectList
+	if claims[resourceQuotasClaim] {
+		lists = append(lists, &corev1.ResourceQuotaList{})
+	}
+	if claims[networkPoliciesClaim] {
+		lists = append(lists, &netv1.NetworkPolicyList{})
+	}
+	if claims[limitRangesClaim] {
+		lists = append(lists, &corev1.LimitRangeList{})
+	}
+	return lists
+}
+
+// kindClaims are the permission claims giving access to the kinds of the managed resources.
+var kindClaims = map[string]apisv1alpha1.GroupResource{
+	"Namespace":     namespacesClaim,
+	"NetworkPolicy": networkPoliciesClaim,
+	"ResourceQuota": resourceQuotasClaim,
+	"LimitRange":    limitRangesClaim,
+}
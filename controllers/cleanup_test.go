@@ -0,0 +1,213 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	cutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+func TestCleanup(t *testing.T) {
+	tests := []struct {
+		name string
+		// whether the namespace has been created by the controller
+		nsControlled bool
+		policy       settingsv1alpha1.CleanupPolicy
+		claims       []apisv1alpha1.GroupResource
+		// names of the objects expected to be deleted, orphaned or left untouched
+		deleted  []string
+		orphaned []string
+		kept     []string
+	}{
+		{
+			name:         "delete the namespace created by the controller",
+			nsControlled: true,
+			policy:       settingsv1alpha1.CleanupPolicyDelete,
+			deleted:      []string{"pipelines"},
+		},
+		{
+			name:    "delete the managed objects of an existing namespace",
+			policy:  settingsv1alpha1.CleanupPolicyDelete,
+			deleted: []string{"settings"},
+			kept:    []string{"pipelines", "tenant"},
+		},
+		{
+			name:         "orphan",
+			nsControlled: true,
+			policy:       settingsv1alpha1.CleanupPolicyOrphan,
+			orphaned:     []string{"pipelines", "settings"},
+			kept:         []string{"tenant"},
+		},
+		{
+			name:         "namespaces claim not accepted",
+			nsControlled: true,
+			policy:       settingsv1alpha1.CleanupPolicyDelete,
+			claims:       []apisv1alpha1.GroupResource{resourceQuotasClaim},
+			deleted:      []string{"settings"},
+			kept:         []string{"pipelines", "tenant"},
+		},
+		{
+			name:         "quotas claim not accepted",
+			nsControlled: false,
+			policy:       settingsv1alpha1.CleanupPolicyDelete,
+			claims:       []apisv1alpha1.GroupResource{namespacesClaim},
+			kept:         []string{"pipelines", "settings", "tenant"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ab := newTestAPIBinding()
+			ab.Finalizers = []string{CleanupFinalizer}
+			var ns client.Object = &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "pipelines"}}
+			if tt.nsControlled {
+				ns = controlledBy(t, ab, ns)
+			}
+			r := newTestReconciler(t, nil, ab, ns,
+				controlledBy(t, ab, &corev1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Namespace: "pipelines", Name: "settings"}}),
+				&corev1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Namespace: "pipelines", Name: "tenant"}},
+			)
+			config := &settingsv1alpha1.SettingsConfig{Namespace: "pipelines", CleanupPolicy: tt.policy}
+
+			ctx := context.Background()
+			claims := acceptedClaims{}
+			for _, claim := range tt.claims {
+				claims[claim] = true
+			}
+			if tt.claims == nil {
+				claims = allClaims()
+			}
+			if err := r.cleanup(ctx, ab, config, claims); err != nil {
+				t.Fatalf("cleanup() failed: %v", err)
+			}
+
+			if err := r.Get(ctx, types.NamespacedName{Name: ab.Name}, ab); err != nil {
+				t.Fatal(err)
+			}
+			if cutil.ContainsFinalizer(ab, CleanupFinalizer) {
+				t.Errorf("the finalizer has not been removed")
+			}
+			get := func(name string) (client.Object, error) {
+				if name == "pipelines" {
+					var ns corev1.Namespace
+					return &ns, r.Get(ctx, types.NamespacedName{Name: name}, &ns)
+				}
+				var quota corev1.ResourceQuota
+				return &quota, r.Get(ctx, types.NamespacedName{Namespace: "pipelines", Name: name}, &quota)
+			}
+			for _, name := range tt.deleted {
+				if _, err := get(name); !errors.IsNotFound(err) {
+					t.Errorf("%s has not been deleted: %v", name, err)
+				}
+			}
+			for _, name := range tt.orphaned {
+				obj, err := get(name)
+				if err != nil {
+					t.Fatalf("%s has been deleted: %v", name, err)
+				}
+				if len(obj.GetOwnerReferences()) > 0 {
+					t.Errorf("%s has not been orphaned: %+v", name, obj.GetOwnerReferences())
+				}
+			}
+			for _, name := range tt.kept {
+				if _, err := get(name); err != nil {
+					t.Errorf("%s has been deleted: %v", name, err)
+				}
+			}
+		})
+	}
+}
+
+func TestCleanupInventory(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy settingsv1alpha1.CleanupPolicy
+		claims []apisv1alpha1.GroupResource
+		// names of the objects expected to be deleted, orphaned or still controlled by the APIBinding
+		deleted    []string
+		orphaned   []string
+		controlled []string
+	}{
+		{
+			name:    "delete",
+			policy:  settingsv1alpha1.CleanupPolicyDelete,
+			deleted: []string{"pipelines", "old", NpName},
+		},
+		{
+			name:     "orphan",
+			policy:   settingsv1alpha1.CleanupPolicyOrphan,
+			orphaned: []string{"pipelines", "old", NpName},
+		},
+		{
+			name:       "network policies claim not accepted",
+			policy:     settingsv1alpha1.CleanupPolicyDelete,
+			claims:     []apisv1alpha1.GroupResource{namespacesClaim},
+			deleted:    []string{"pipelines", "old"},
+			controlled: []string{NpName},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ab := newTestAPIBinding()
+			ab.Finalizers = []string{CleanupFinalizer}
+			// The namespace configured when the workspace was last reconciled differs from the current one.
+			s := &settingsv1alpha1.Settings{
+				ObjectMeta: metav1.ObjectMeta{Name: SettingName},
+				Status: settingsv1alpha1.SettingsStatus{ManagedResources: []settingsv1alpha1.ManagedResource{
+					{Kind: "Namespace", Name: "pipelines"},
+					{Kind: "Namespace", Name: "old"},
+					{Group: netv1.GroupName, Kind: "NetworkPolicy", Namespace: "old", Name: NpName},
+				}},
+			}
+			r := newTestReconciler(t, nil, ab, s,
+				controlledBy(t, ab, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "pipelines"}}),
+				controlledBy(t, ab, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "old"}}),
+				controlledBy(t, ab, &netv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "old", Name: NpName}}),
+			)
+			config := &settingsv1alpha1.SettingsConfig{Namespace: "pipelines", CleanupPolicy: tt.policy}
+
+			ctx := context.Background()
+			claims := allClaims()
+			if tt.claims != nil {
+				claims = acceptedClaims{}
+				for _, claim := range tt.claims {
+					claims[claim] = true
+				}
+			}
+			if err := r.cleanup(ctx, ab, config, claims); err != nil {
+				t.Fatalf("cleanup() failed: %v", err)
+			}
+
+			get := func(name string) (client.Object, error) {
+				if name == NpName {
+					var np netv1.NetworkPolicy
+					return &np, r.Get(ctx, types.NamespacedName{Namespace: "old", Name: name}, &np)
+				}
+				var ns corev1.Namespace
+				return &ns, r.Get(ctx, types.NamespacedName{Name: name}, &ns)
+			}
+			for _, name := range tt.deleted {
+				if _, err := get(name); !errors.IsNotFound(err) {
+					t.Errorf("%s has not been deleted: %v", name, err)
+				}
+			}
+			for _, name := range append(tt.orphaned, tt.controlled...) {
+				obj, err := get(name)
+				if err != nil {
+					t.Fatalf("%s has been deleted: %v", name, err)
+				}
+				if controlled, expected := metav1.IsControlledBy(obj, ab), !contains(tt.orphaned, name); controlled != expected {
+					t.Errorf("%s: controlled by the APIBinding is %t, expected %t", name, controlled, expected)
+				}
+			}
+		})
+	}
+}
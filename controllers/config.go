@@ -0,0 +1,198 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+	ctrlcfg "sigs.k8s.io/controller-runtime/pkg/config/v1alpha1"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+// ConfigHistoryLimit is the number of configurations kept by the ConfigStore, so that the workspaces
+// not selected yet by a rollout can still be reconciled against the configuration last applied to them.
+const ConfigHistoryLimit = 10
+
+// ConfigStore holds the controller configuration and the previous ones, indexed by their hashes.
+// It is safe for concurrent use so that the configuration can be replaced while the controller is running.
+// The history is kept in memory and does not survive a restart of the controller.
+type ConfigStore struct {
+	lock    sync.RWMutex
+	config  settingsv1alpha1.SettingsConfig
+	history map[string]settingsv1alpha1.SettingsConfig
+	// hashes of the configurations in the history, the oldest first
+	hashes []string
+}
+
+// NewConfigStore returns a ConfigStore initialized with the provided configuration.
+func NewConfigStore(config settingsv1alpha1.SettingsConfig) *ConfigStore {
+	c := &ConfigStore{config: *config.DeepCopy(), history: map[string]settingsv1alpha1.SettingsConfig{}}
+	c.record(config)
+	return c
+}
+
+// Get returns a copy of the current configuration.
+func (c *ConfigStore) Get() settingsv1alpha1.SettingsConfig {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return *c.config.DeepCopy()
+}
+
+// Set replaces the current configuration.
+func (c *ConfigStore) Set(config settingsv1alpha1.SettingsConfig) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.config = *config.DeepCopy()
+	c.record(config)
+}
+
+// Lookup returns a copy of the configuration with the hash, if it is still in the history.
+func (c *ConfigStore) Lookup(hash string) (settingsv1alpha1.SettingsConfig, bool) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	config, ok := c.history[hash]
+	if !ok {
+		return settingsv1alpha1.SettingsConfig{}, false
+	}
+	return *config.DeepCopy(), true
+}
+
+// record adds the configuration to the history and evicts the oldest ones above ConfigHistoryLimit.
+// It needs to be called with the lock held.
+func (c *ConfigStore) record(config settingsv1alpha1.SettingsConfig) {
+	h, err := configHash(config)
+	if err != nil {
+		return
+	}
+	if _, ok := c.history[h]; ok {
+		// Move the configuration to the end so that it is evicted last.
+		for i, hash := range c.hashes {
+			if hash == h {
+				c.hashes = append(c.hashes[:i], c.hashes[i+1:]...)
+				break
+			}
+		}
+	}
+	c.history[h] = *config.DeepCopy()
+	c.hashes = append(c.hashes, h)
+	for len(c.hashes) > ConfigHistoryLimit {
+		delete(c.history, c.hashes[0])
+		c.hashes = c.hashes[1:]
+	}
+}
+
+// configHash returns the hash of the settings of the configuration. The generic configuration
+// of the manager and the rollout strategy are ignored as they are not rolled out to the workspaces:
+// pausing a rollout or increasing its percentage does not start a new one.
+// The quota overrides are ignored as well: they target single workspaces and are applied without rollout.
+func configHash(config settingsv1alpha1.SettingsConfig) (string, error) {
+	config.TypeMeta = metav1.TypeMeta{}
+	config.ControllerManagerConfigurationSpec = ctrlcfg.ControllerManagerConfigurationSpec{}
+	config.Rollout = nil
+	config.MaxQuotaOverrides = nil
+	config.QuotaOverrides = nil
+	return hash(config)
+}
+
+// ConfigWatcher watches the configuration file of the controller and loads it into the ConfigStore
+// when it changes. Only the settings are taken into account, changes to the generic configuration
+// of the manager (metrics, health probes, leader election, etc.) still require a restart.
+type ConfigWatcher struct {
+	// Path of the configuration file
+	Path string
+	// Scheme used for decoding the configuration file
+	Scheme *runtime.Scheme
+	// Store is updated with the new configuration
+	Store *ConfigStore
+	// OnChange is called after a new configuration has been stored
+	OnChange func(ctx context.Context) error
+}
+
+// Start implements manager.Runnable. It blocks till the context is cancelled.
+func (w *ConfigWatcher) Start(ctx context.Context) error {
+	logger := ctrl.Log.WithName("config-watcher").WithValues("path", w.Path)
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return fmt.Errorf("error creating the configuration file watcher: %w", err)
+	}
+	defer watcher.Close()
+
+	// The directory is watched rather than the file itself as a mounted ConfigMap
+	// gets updated through the replacement of a symbolic link.
+	if err := watcher.Add(filepath.Dir(w.Path)); err != nil {
+		return fmt.Errorf("error watching the configuration file %q: %w", w.Path, err)
+	}
+
+	// The file may have changed before the watch was started,
+	// when this instance was waiting to be elected for instance.
+	w.reload(ctx)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Rename|fsnotify.Remove) == 0 {
+				continue
+			}
+			logger.V(3).Info("Configuration directory changed", "event", event.String())
+			w.reload(ctx)
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			logger.Error(err, "error watching the configuration file")
+		}
+	}
+}
+
+// reload loads the configuration file and stores it, if it differs from the current configuration.
+// An invalid file is reported and the current configuration is kept.
+func (w *ConfigWatcher) reload(ctx context.Context) {
+	logger := ctrl.Log.WithName("config-watcher").WithValues("path", w.Path)
+
+	var config settingsv1alpha1.SettingsConfig
+	loader := ctrl.ConfigFile().AtPath(w.Path).OfKind(&config)
+	if err := loader.InjectScheme(w.Scheme); err != nil {
+		logger.Error(err, "unable to load the configuration file")
+		return
+	}
+	if _, err := loader.Complete(); err != nil {
+		logger.Error(err, "unable to load the configuration file, keeping the current configuration")
+		return
+	}
+
+	if errs := ValidateConfig(&config); len(errs) > 0 {
+		logger.Error(errs.ToAggregate(), "invalid configuration, keeping the current configuration")
+		return
+	}
+
+	current := w.Store.Get()
+	// The generic manager configuration cannot be changed at runtime.
+	config.ControllerManagerConfigurationSpec = current.ControllerManagerConfigurationSpec
+	if equality.Semantic.DeepEqual(current, config) {
+		logger.V(3).Info("Configuration unchanged")
+		return
+	}
+
+	w.Store.Set(config)
+	h, _ := configHash(config)
+	logger.Info("Configuration reloaded", "hash", h)
+
+	if w.OnChange != nil {
+		if err := w.OnChange(ctx); err != nil {
+			logger.Error(err, "unable to propagate the new configuration")
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+// testConfig returns the configuration as loaded from a file written by writeConfigFile.
+func testConfig(namespace string) settingsv1alpha1.SettingsConfig {
+	config := validConfig()
+	config.TypeMeta = metav1.TypeMeta{APIVersion: settingsv1alpha1.GroupVersion.String(), Kind: "SettingsConfig"}
+	config.Namespace = namespace
+	return config
+}
+
+// writeConfigFile writes a configuration file with the namespace and returns its path.
+func writeConfigFile(t *testing.T, dir, namespace string) string {
+	path := filepath.Join(dir, "config.yaml")
+	// JSON is valid YAML.
+	content, err := json.Marshal(testConfig(namespace))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, content, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigStore(t *testing.T) {
+	store := NewConfigStore(settingsv1alpha1.SettingsConfig{
+		Namespace:   "pipelines",
+		QuotaConfig: settingsv1alpha1.SettingsQuotaConfig{Spec: corev1.ResourceQuotaSpec{Hard: resourceList("pods", "10")}},
+	})
+
+	// The copies returned by the store can be modified without affecting it.
+	config := store.Get()
+	config.QuotaConfig.Spec.Hard["pods"] = resourceList("pods", "20")["pods"]
+	if pods := store.Get().QuotaConfig.Spec.Hard["pods"]; pods.String() != "10" {
+		t.Errorf("the stored configuration has been modified through a copy: %s pods", pods.String())
+	}
+
+	store.Set(config)
+	config.Namespace = "other"
+	if current := store.Get(); current.Namespace != "pipelines" || current.QuotaConfig.Spec.Hard.Pods().String() != "20" {
+		t.Errorf("unexpected configuration after Set(): %+v", current)
+	}
+}
+
+func TestConfigStoreHistory(t *testing.T) {
+	first := testConfig("ns-0")
+	store := NewConfigStore(first)
+	firstHash, _ := configHash(first)
+	if config, ok := store.Lookup(firstHash); !ok || config.Namespace != "ns-0" {
+		t.Fatalf("Lookup() of the initial configuration = %+v, %t", config, ok)
+	}
+	if _, ok := store.Lookup("unknown"); ok {
+		t.Errorf("Lookup() found an unknown configuration")
+	}
+
+	// Setting the initial configuration again makes it the most recent one.
+	second := testConfig("ns-1")
+	store.Set(second)
+	store.Set(first)
+	for i := 2; i < ConfigHistoryLimit; i++ {
+		store.Set(testConfig(fmt.Sprintf("ns-%d", i)))
+	}
+	if _, ok := store.Lookup(firstHash); !ok {
+		t.Errorf("the initial configuration has been evicted while it was set again")
+	}
+	secondHash, _ := configHash(second)
+	if _, ok := store.Lookup(secondHash); !ok {
+		t.Errorf("the second configuration has been evicted before the history was full")
+	}
+
+	// The history is full, the oldest configuration is evicted.
+	store.Set(testConfig("ns-new"))
+	if _, ok := store.Lookup(secondHash); ok {
+		t.Errorf("the oldest configuration has not been evicted")
+	}
+	if _, ok := store.Lookup(firstHash); !ok {
+		t.Errorf("the initial configuration has been evicted")
+	}
+
+	// The copies returned by Lookup can be modified without affecting the history.
+	config, _ := store.Lookup(firstHash)
+	config.Namespace = "other"
+	if config, _ := store.Lookup(firstHash); config.Namespace != "ns-0" {
+		t.Errorf("the configuration in the history has been modified through a copy: %q", config.Namespace)
+	}
+}
+
+func TestConfigHash(t *testing.T) {
+	config := testConfig("pipelines")
+	h, err := configHash(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The generic configuration of the manager is not rolled out to the workspaces.
+	config.TypeMeta = metav1.TypeMeta{}
+	config.Metrics.BindAddress = ":9090"
+	if managerHash, _ := configHash(config); managerHash != h {
+		t.Errorf("the hash changed with the configuration of the manager: %s, expected %s", managerHash, h)
+	}
+	// Pausing a rollout does not start a new one.
+	config.Rollout = &settingsv1alpha1.SettingsRolloutStrategy{Paused: true}
+	if rolloutHash, _ := configHash(config); rolloutHash != h {
+		t.Errorf("the hash changed with the rollout strategy: %s, expected %s", rolloutHash, h)
+	}
+	// The quota overrides are applied without rollout.
+	config.MaxQuotaOverrides = resourceList("pods", "20")
+	config.QuotaOverrides = []settingsv1alpha1.SettingsQuotaOverride{{Workspace: "root:org:ws", Hard: resourceList("pods", "20")}}
+	if overridesHash, _ := configHash(config); overridesHash != h {
+		t.Errorf("the hash changed with the quota overrides: %s, expected %s", overridesHash, h)
+	}
+	config.Namespace = "other"
+	if nsHash, _ := configHash(config); nsHash == h {
+		t.Errorf("the hash did not change with the namespace")
+	}
+}
+
+func TestConfigWatcherReload(t *testing.T) {
+	tests := []struct {
+		name string
+		// namespace written in the configuration file, no file is written if empty
+		fileNamespace string
+		malformed     bool
+		namespace     string
+		changed       bool
+	}{
+		{name: "new configuration", fileNamespace: "other", namespace: "other", changed: true},
+		{name: "unchanged configuration", fileNamespace: "pipelines", namespace: "pipelines"},
+		{name: "invalid configuration", fileNamespace: "Pipelines", namespace: "pipelines"},
+		{name: "malformed configuration", malformed: true, namespace: "pipelines"},
+		{name: "missing file", namespace: "pipelines"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			path := filepath.Join(dir, "config.yaml")
+			if tt.fileNamespace != "" {
+				path = writeConfigFile(t, dir, tt.fileNamespace)
+			}
+			if tt.malformed {
+				if err := os.WriteFile(path, []byte("namespace: ["), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			changed := false
+			w := &ConfigWatcher{
+				Path:   path,
+				Scheme: newTestScheme(t),
+				Store:  NewConfigStore(testConfig("pipelines")),
+				OnChange: func(context.Context) error {
+					changed = true
+					return nil
+				},
+			}
+			w.reload(context.Background())
+			if namespace := w.Store.Get().Namespace; namespace != tt.namespace {
+				t.Errorf("namespace is %q, expected %q", namespace, tt.namespace)
+			}
+			if changed != tt.changed {
+				t.Errorf("OnChange called: %t, expected %t", changed, tt.changed)
+			}
+		})
+	}
+}
+
+func TestConfigWatcherStart(t *testing.T) {
+	dir := t.TempDir()
+	changes := make(chan string, 10)
+	w := &ConfigWatcher{
+		Path:   writeConfigFile(t, dir, "pipelines"),
+		Scheme: newTestScheme(t),
+		Store:  NewConfigStore(testConfig("pipelines")),
+	}
+	w.OnChange = func(context.Context) error {
+		changes <- w.Store.Get().Namespace
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- w.Start(ctx) }()
+	defer func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("Start() failed: %v", err)
+		}
+	}()
+
+	// The watch may not be established yet, the file is written till the change is seen.
+	timeout := time.After(10 * time.Second)
+	for {
+		writeConfigFile(t, dir, "other")
+		select {
+		case namespace := <-changes:
+			if namespace != "other" {
+				t.Fatalf("reloaded namespace is %q, expected %q", namespace, "other")
+			}
+			return
+		case <-time.After(100 * time.Millisecond):
+		case <-timeout:
+			t.Fatal("the configuration has not been reloaded")
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package controllers
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// DesiredHashAnnotation records on the managed resources the hash of the desired specification last applied.
+// It allows distinguishing changes made by a third party from changes of the configuration.
+const DesiredHashAnnotation = "configuration.pipeline-service.io/desired-hash"
+
+// driftEntry describes the fields of a managed resource, which differed from the desired state.
+type driftEntry struct {
+	kind   string
+	name   string
+	fields []string
+	// corrected is set once the desired state has been applied again
+	corrected bool
+}
+
+// driftReport accumulates the drifts detected during a reconciliation.
+type driftReport struct {
+	// export is the name of the APIExport used in the metrics
+	export  string
+	entries []driftEntry
+}
+
+// check records a drift when the live object was last applied with the same desired specification
+// but some of the desired fields have changed since then.
+// It needs to be called with the live object before it is mutated. The drift is only reported as corrected
+// when corrected is called after the desired state has been successfully applied.
+func (d *driftReport) check(kind string, obj client.Object, live, desired interface{}, desiredHash string) error {
+	if obj.GetResourceVersion() == "" || obj.GetAnnotations()[DesiredHashAnnotation] != desiredHash {
+		// The object does not exist yet or the desired state has changed.
+		return nil
+	}
+	fields, err := changedFields(live, desired)
+	if err != nil {
+		return err
+	}
+	if len(fields) > 0 {
+		d.entries = append(d.entries, driftEntry{kind: kind, name: obj.GetName(), fields: fields})
+	}
+	return nil
+}
+
+// corrected marks the drift of the resource, if any, as corrected.
+func (d *driftReport) corrected(kind, name string) {
+	for i := range d.entries {
+		if d.entries[i].kind == kind && d.entries[i].name == name {
+			d.entries[i].corrected = true
+		}
+	}
+}
+
+// count increments the drift counter for each detected drift, labelled with whether it has been corrected.
+// It is called once, after the desired state has been applied.
+func (d *driftReport) count() {
+	for _, entry := range d.entries {
+		driftTotal.WithLabelValues(d.export, entry.kind, strconv.FormatBool(entry.corrected)).Inc()
+	}
+}
+
+// empty returns true if no drift has been detected.
+func (d *driftReport) empty() bool {
+	return len(d.entries) == 0
+}
+
+// uncorrected returns true if some of the drifts could not be corrected.
+func (d *driftReport) uncorrected() bool {
+	for _, entry := range d.entries {
+		if !entry.corrected {
+			return true
+		}
+	}
+	return false
+}
+
+// summary returns a human readable description of the drifts, which have or have not been corrected.
+func (d *driftReport) summary(corrected bool) string {
+	var parts []string
+	for _, entry := range d.entries {
+		if entry.corrected != corrected {
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%s %q: %s", entry.kind, entry.name, strings.Join(entry.fields, ", ")))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// setDesiredHash records the hash of the desired specification on the object.
+func setDesiredHash(obj client.Object, desiredHash string) {
+	annotations := obj.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[DesiredHashAnnotation] = desiredHash
+	obj.SetAnnotations(annotations)
+}
+
+// hash returns a short hash of the JSON serialization of the value.
+func hash(v interface{}) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x", sha256.Sum256(b))[:16], nil
+}
+
+// changedFields returns the sorted paths of the fields set in desired, which have a different value in live.
+// Fields only set in live are ignored. Both parameters need to be pointers to structs.
+func changedFields(live, desired interface{}) ([]string, error) {
+	liveMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(live)
+	if err != nil {
+		return nil, err
+	}
+	desiredMap, err := runtime.DefaultUnstructuredConverter.ToUnstructured(desired)
+	if err != nil {
+		return nil, err
+	}
+	var fields []string
+	compareValues("spec", liveMap, desiredMap, &fields)
+	sort.Strings(fields)
+	return fields, nil
+}
+
+// compareValues appends to fields the path of the values set in desired, which differ in live.
+// Maps and lists of the same length are compared element by element so that fields defaulted
+// by the API server are not reported.
+func compareValues(path string, live, desired interface{}, fields *[]string) {
+	switch desiredValue := desired.(type) {
+	case map[string]interface{}:
+		liveValue, ok := live.(map[string]interface{})
+		if !ok {
+			*fields = append(*fields, path)
+			return
+		}
+		for key, desiredChild := range desiredValue {
+			liveChild, ok := liveValue[key]
+			if !ok {
+				*fields = append(*fields, path+"."+key)
+				continue
+			}
+			compareValues(path+"."+key, liveChild, desiredChild, fields)
+		}
+	case []interface{}:
+		liveValue, ok := live.([]interface{})
+		if !ok || len(liveValue) != len(desiredValue) {
+			*fields = append(*fields, path)
+			return
+		}
+		for i := range desiredValue {
+			compareValues(fmt.Sprintf("%s[%d]", path, i), liveValue[i], desiredValue[i], fields)
+		}
+	default:
+		if !reflect.DeepEqual(live, desired) {
+			*fields = append(*fields, path)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+func TestChangedFields(t *testing.T) {
+	tcp := corev1.ProtocolTCP
+	tests := []struct {
+		name    string
+		live    interface{}
+		desired interface{}
+		fields  []string
+	}{
+		{
+			name:    "unchanged",
+			live:    &corev1.ResourceQuotaSpec{Hard: resourceList("pods", "10")},
+			desired: &corev1.ResourceQuotaSpec{Hard: resourceList("pods", "10")},
+		},
+		{
+			name:    "changed value",
+			live:    &corev1.ResourceQuotaSpec{Hard: resourceList("pods", "20", "cpu", "1")},
+			desired: &corev1.ResourceQuotaSpec{Hard: resourceList("pods", "10", "cpu", "1")},
+			fields:  []string{"spec.hard.pods"},
+		},
+		{
+			name:    "removed value",
+			live:    &corev1.ResourceQuotaSpec{Hard: resourceList("cpu", "1")},
+			desired: &corev1.ResourceQuotaSpec{Hard: resourceList("pods", "10", "cpu", "1")},
+			fields:  []string{"spec.hard.pods"},
+		},
+		{
+			name:    "field only set in live",
+			live:    &corev1.ResourceQuotaSpec{Hard: resourceList("pods", "10", "cpu", "1")},
+			desired: &corev1.ResourceQuotaSpec{Hard: resourceList("pods", "10")},
+		},
+		{
+			name: "changed list and selector",
+			live: &netv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "other"}},
+				PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeIngress},
+			},
+			desired: &netv1.NetworkPolicySpec{
+				PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "build"}},
+				PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeIngress, netv1.PolicyTypeEgress},
+			},
+			fields: []string{"spec.podSelector.matchLabels.app", "spec.policyTypes"},
+		},
+		{
+			name: "defaulted field in a list element",
+			live: &netv1.NetworkPolicySpec{
+				Ingress: []netv1.NetworkPolicyIngressRule{{Ports: []netv1.NetworkPolicyPort{{Protocol: &tcp}}}},
+			},
+			desired: &netv1.NetworkPolicySpec{
+				Ingress: []netv1.NetworkPolicyIngressRule{{Ports: []netv1.NetworkPolicyPort{{}}}},
+			},
+		},
+		{
+			name:    "changed list element",
+			live:    &netv1.NetworkPolicySpec{PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeIngress, netv1.PolicyTypeIngress}},
+			desired: &netv1.NetworkPolicySpec{PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeIngress, netv1.PolicyTypeEgress}},
+			fields:  []string{"spec.policyTypes[1]"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fields, err := changedFields(tt.live, tt.desired)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("changedFields() = %v, expected %v", fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestCompareValues(t *testing.T) {
+	tests := []struct {
+		name    string
+		live    interface{}
+		desired interface{}
+		fields  []string
+	}{
+		{name: "equal scalars", live: "a", desired: "a"},
+		{name: "different scalars", live: "a", desired: "b", fields: []string{"spec"}},
+		{name: "map replaced by a scalar", live: "a", desired: map[string]interface{}{"k": "v"}, fields: []string{"spec"}},
+		{name: "list replaced by a scalar", live: "a", desired: []interface{}{"v"}, fields: []string{"spec"}},
+		{name: "missing key", live: map[string]interface{}{}, desired: map[string]interface{}{"k": "v"}, fields: []string{"spec.k"}},
+		{
+			name:    "nested difference",
+			live:    map[string]interface{}{"l": []interface{}{map[string]interface{}{"k": int64(1)}}},
+			desired: map[string]interface{}{"l": []interface{}{map[string]interface{}{"k": int64(2)}}},
+			fields:  []string{"spec.l[0].k"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fields []string
+			compareValues("spec", tt.live, tt.desired, &fields)
+			if !reflect.DeepEqual(fields, tt.fields) {
+				t.Errorf("compareValues() = %v, expected %v", fields, tt.fields)
+			}
+		})
+	}
+}
+
+func TestDriftReport(t *testing.T) {
+	desired := &corev1.ResourceQuotaSpec{Hard: resourceList("pods", "10")}
+	desiredHash, err := hash(desired)
+	if err != nil {
+		t.Fatal(err)
+	}
+	quota := func(name, resourceVersion, desiredHash, pods string) *corev1.ResourceQuota {
+		q := &corev1.ResourceQuota{
+			ObjectMeta: metav1.ObjectMeta{Name: name, ResourceVersion: resourceVersion},
+			Spec:       corev1.ResourceQuotaSpec{Hard: resourceList("pods", pods)},
+		}
+		setDesiredHash(q, desiredHash)
+		return q
+	}
+
+	var d driftReport
+	for _, live := range []*corev1.ResourceQuota{
+		// not created yet
+		quota("new", "", desiredHash, "20"),
+		// last applied with another desired state
+		quota("reconfigured", "1", "other", "20"),
+		quota("unchanged", "1", desiredHash, "10"),
+		quota("edited", "1", desiredHash, "20"),
+	} {
+		if err := d.check("ResourceQuota", live, &live.Spec, desired, desiredHash); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if d.empty() {
+		t.Fatal("no drift detected")
+	}
+	if got, expected := d.summary(false), `ResourceQuota "edited": spec.hard.pods`; got != expected {
+		t.Errorf("summary(false) = %q, expected %q", got, expected)
+	}
+	if !d.uncorrected() || d.summary(true) != "" {
+		t.Errorf("the drift is reported as corrected before the desired state has been applied: %+v", d.entries)
+	}
+
+	d.corrected("ResourceQuota", "unchanged")
+	if !d.uncorrected() {
+		t.Errorf("the drift is reported as corrected after another resource has been applied: %+v", d.entries)
+	}
+	d.corrected("ResourceQuota", "edited")
+	if d.uncorrected() || d.summary(false) != "" {
+		t.Errorf("the drift is not reported as corrected: %+v", d.entries)
+	}
+	if got, expected := d.summary(true), `ResourceQuota "edited": spec.hard.pods`; got != expected {
+		t.Errorf("summary(true) = %q, expected %q", got, expected)
+	}
+}
+
+func TestReconcileResourceQuotasDrift(t *testing.T) {
+	tests := []struct {
+		name string
+		// hard limits set by the tenant
+		edited    corev1.ResourceList
+		conflict  bool
+		corrected string
+	}{
+		// The field is owned by the tenant, the controller does not override it.
+		{name: "changed limit", edited: resourceList("pods", "100", "cpu", "1"), conflict: true, corrected: "100"},
+		// The field does not exist anymore, there is no conflict.
+		{name: "removed limit", edited: resourceList("cpu", "1"), corrected: "10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ab := newTestAPIBinding()
+			r := newTestReconciler(t, nil, ab)
+			quotas := []settingsv1alpha1.NamedResourceQuota{{Name: QtName, Spec: corev1.ResourceQuotaSpec{Hard: resourceList("pods", "10", "cpu", "1")}}}
+
+			ctx := context.Background()
+			var created driftReport
+			if _, err := r.reconcileResourceQuotas(ctx, ab, "pipelines", quotas, &created, nil, newInventory(nil)); err != nil {
+				t.Fatal(err)
+			}
+			if !created.empty() {
+				t.Errorf("drift detected on creation: %s", created.summary(false))
+			}
+
+			var quota corev1.ResourceQuota
+			if err := r.Get(ctx, types.NamespacedName{Namespace: "pipelines", Name: QtName}, &quota); err != nil {
+				t.Fatal(err)
+			}
+			quota.Spec.Hard = tt.edited
+			if err := r.Update(ctx, &quota, client.FieldOwner("kubectl-edit")); err != nil {
+				t.Fatal(err)
+			}
+
+			drifts := driftReport{export: testExportName}
+			counted := testutil.ToFloat64(driftTotal.WithLabelValues(testExportName, "ResourceQuota", strconv.FormatBool(!tt.conflict)))
+			_, err := r.reconcileResourceQuotas(ctx, ab, "pipelines", quotas, &drifts, nil, newInventory(nil))
+			if isConflict(err) != tt.conflict {
+				t.Errorf("reconcileResourceQuotas() error = %v, expected a conflict: %t", err, tt.conflict)
+			}
+			// The drift is only reported as corrected when the quota could be applied.
+			if got, expected := drifts.summary(!tt.conflict), `ResourceQuota "settings": spec.hard.pods`; got != expected {
+				t.Errorf("summary(%t) = %q, expected %q", !tt.conflict, got, expected)
+			}
+			if drifts.uncorrected() != tt.conflict {
+				t.Errorf("uncorrected() = %t, expected %t", drifts.uncorrected(), tt.conflict)
+			}
+			drifts.count()
+			if got := testutil.ToFloat64(driftTotal.WithLabelValues(testExportName, "ResourceQuota", strconv.FormatBool(!tt.conflict))); got != counted+1 {
+				t.Errorf("the drift has been counted %v times, expected once", got-counted)
+			}
+			if err := r.Get(ctx, types.NamespacedName{Namespace: "pipelines", Name: QtName}, &quota); err != nil {
+				t.Fatal(err)
+			}
+			if pods := quota.Spec.Hard["pods"]; pods.String() != tt.corrected {
+				t.Errorf("the quota has %s pods, expected %s", pods.String(), tt.corrected)
+			}
+		})
+	}
+}
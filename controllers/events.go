@@ -0,0 +1,102 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/reference"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	cutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+// settingsEvents records events on the Settings of a workspace so that its owner can see
+// what the controller did with kubectl describe. Nothing is recorded when the events claim
+// has not been accepted. A nil settingsEvents records nothing.
+// The events are created with the cluster-aware client and the context of the reconciliation,
+// which carries the logical cluster of the workspace. The event recorder of the manager is not
+// cluster-aware and would not deliver them to the workspace.
+type settingsEvents struct {
+	ctx    context.Context
+	client client.Client
+	ref    *corev1.ObjectReference
+}
+
+// newSettingsEvents returns a settingsEvents for the Settings, or nil if events cannot be created in the workspace.
+func (r *SettingsReconciler) newSettingsEvents(ctx context.Context, s *settingsv1alpha1.Settings, claims acceptedClaims) *settingsEvents {
+	if !claims[eventsClaim] {
+		return nil
+	}
+	ref, err := reference.GetReference(r.Scheme, s)
+	if err != nil {
+		ctrl.LoggerFrom(ctx).Error(err, "unable to reference the Settings, no event will be recorded")
+		return nil
+	}
+	return &settingsEvents{ctx: ctx, client: r.Client, ref: ref}
+}
+
+// applied records the creation or the update of a managed resource. Unchanged resources are not reported.
+func (e *settingsEvents) applied(kind, name string, result cutil.OperationResult) {
+	if e == nil {
+		return
+	}
+	switch result {
+	case cutil.OperationResultCreated:
+		e.record(corev1.EventTypeNormal, kind+"Created", fmt.Sprintf("%s %q created", kind, name))
+	case cutil.OperationResultUpdated:
+		e.record(corev1.EventTypeNormal, kind+"Updated", fmt.Sprintf("%s %q updated", kind, name))
+	}
+}
+
+// deleted records the deletion of a managed resource, which is not configured anymore.
+func (e *settingsEvents) deleted(kind, name string) {
+	if e == nil {
+		return
+	}
+	e.record(corev1.EventTypeNormal, kind+"Deleted", fmt.Sprintf("%s %q deleted", kind, name))
+}
+
+// orphaned records the release of a managed resource, which is not configured anymore but is kept.
+func (e *settingsEvents) orphaned(kind, name string) {
+	if e == nil {
+		return
+	}
+	e.record(corev1.EventTypeNormal, kind+"Orphaned", fmt.Sprintf("%s %q orphaned", kind, name))
+}
+
+// warning records a failure.
+func (e *settingsEvents) warning(reason string, message string, args ...interface{}) {
+	if e == nil {
+		return
+	}
+	e.record(corev1.EventTypeWarning, reason, fmt.Sprintf(message, args...))
+}
+
+// record creates the event in the workspace. The Settings being cluster scoped, the event is created
+// in the default namespace as done by the client-go event recorder. Failures are only logged.
+func (e *settingsEvents) record(eventType, reason, message string) {
+	now := metav1.NewTime(time.Now())
+	event := &corev1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%v.%x", e.ref.Name, now.UnixNano()),
+			Namespace: metav1.NamespaceDefault,
+		},
+		InvolvedObject:      *e.ref,
+		Reason:              reason,
+		Message:             message,
+		Type:                eventType,
+		Source:              corev1.EventSource{Component: FieldManager},
+		FirstTimestamp:      now,
+		LastTimestamp:       now,
+		Count:               1,
+		ReportingController: FieldManager,
+	}
+	if err := e.client.Create(e.ctx, event); err != nil {
+		ctrl.LoggerFrom(e.ctx).V(1).Info("Unable to record event", "reason", reason, "error", err.Error())
+	}
+}
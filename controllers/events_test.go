@@ -0,0 +1,84 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kcp-dev/logicalcluster/v2"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	cutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+// clusterRecordingClient records the logical cluster of the context the objects are created in.
+type clusterRecordingClient struct {
+	client.Client
+	clusters map[string]logicalcluster.Name
+}
+
+func (c *clusterRecordingClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	cluster, _ := logicalcluster.ClusterFromContext(ctx)
+	c.clusters[obj.GetName()] = cluster
+	return c.Client.Create(ctx, obj, opts...)
+}
+
+func TestSettingsEvents(t *testing.T) {
+	scheme := newTestScheme(t)
+	cluster := logicalcluster.New("root:org:ws")
+	s := &settingsv1alpha1.Settings{ObjectMeta: metav1.ObjectMeta{Name: SettingName, UID: "uid"}}
+
+	tests := []struct {
+		name     string
+		claims   acceptedClaims
+		expected []string
+	}{
+		{
+			name:   "events claim accepted",
+			claims: acceptedClaims{eventsClaim: true},
+			expected: []string{
+				`Normal NetworkPolicyCreated NetworkPolicy "default-deny" created`,
+				`Normal NetworkPolicyUpdated NetworkPolicy "default-deny" updated`,
+				`Normal NetworkPolicyDeleted NetworkPolicy "stale" deleted`,
+				`Warning NamespaceFailed Unable to apply the namespace "pipelines"`,
+			},
+		},
+		{name: "events claim not accepted", claims: acceptedClaims{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &clusterRecordingClient{
+				Client:   fake.NewClientBuilder().WithScheme(scheme).Build(),
+				clusters: map[string]logicalcluster.Name{},
+			}
+			r := &SettingsReconciler{Client: c, Scheme: scheme}
+			ctx := logicalcluster.WithCluster(context.Background(), cluster)
+
+			events := r.newSettingsEvents(ctx, s, tt.claims)
+			events.applied("NetworkPolicy", "default-deny", cutil.OperationResultCreated)
+			events.applied("NetworkPolicy", "default-deny", cutil.OperationResultUpdated)
+			events.applied("NetworkPolicy", "default-deny", cutil.OperationResultNone)
+			events.deleted("NetworkPolicy", "stale")
+			events.warning("NamespaceFailed", "Unable to apply the namespace %q", "pipelines")
+
+			var list corev1.EventList
+			if err := c.List(ctx, &list); err != nil {
+				t.Fatal(err)
+			}
+			for _, e := range list.Items {
+				if e.InvolvedObject.Name != SettingName || e.InvolvedObject.Kind != "Settings" {
+					t.Errorf("event %s involves %s %q", e.Name, e.InvolvedObject.Kind, e.InvolvedObject.Name)
+				}
+				if got := c.clusters[e.Name]; got != cluster {
+					t.Errorf("event %s created in cluster %q, expected %q", e.Name, got, cluster)
+				}
+			}
+			if recorded := takeEvents(t, c); !sameElements(recorded, tt.expected) {
+				t.Errorf("recorded events %q, expected %q", recorded, tt.expected)
+			}
+		})
+	}
+}
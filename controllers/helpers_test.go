@@ -0,0 +1,551 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/runtime"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// newTestScheme returns a scheme with the types used by the controller.
+func newTestScheme(t *testing.T) *runtime.Scheme {
+	scheme := runtime.NewScheme()
+	for _, addToScheme := range []func(*runtime.Scheme) error{clientgoscheme.AddToScheme, apisv1alpha1.AddToScheme, settingsv1alpha1.AddToScheme} {
+		if err := addToScheme(scheme); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return scheme
+}
+
+// Reference and identity of the APIExport, which the APIBindings of the tests bind to.
+const (
+	testExportName      = "settings-configuration.pipeline-service.io"
+	testExportWorkspace = "root:pipeline-service"
+	testExportIdentity  = "settings-identity"
+)
+
+// newTestAPIBinding returns an APIBinding to the test export, which can be set as the controller of the managed objects.
+func newTestAPIBinding() *apisv1alpha1.APIBinding {
+	return &apisv1alpha1.APIBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "settings", UID: "ab-uid"},
+		Spec: apisv1alpha1.APIBindingSpec{Reference: apisv1alpha1.ExportReference{
+			Workspace: &apisv1alpha1.WorkspaceExportReference{Path: testExportWorkspace, ExportName: testExportName},
+		}},
+		Status: apisv1alpha1.APIBindingStatus{BoundResources: boundResources(testExportIdentity)},
+	}
+}
+
+// boundResources returns a bound resource per APIExport identity.
+func boundResources(identities ...string) []apisv1alpha1.BoundAPIResource {
+	var resources []apisv1alpha1.BoundAPIResource
+	for _, identity := range identities {
+		resources = append(resources, apisv1alpha1.BoundAPIResource{
+			Group:    settingsv1alpha1.GroupVersion.Group,
+			Resource: "settings",
+			Schema:   apisv1alpha1.BoundAPIResourceSchema{Name: "settings", UID: identity + "-uid", IdentityHash: identity},
+		})
+	}
+	return resources
+}
+
+// allClaims returns the permission claims required by the controller as accepted.
+func allClaims() acceptedClaims {
+	claims := acceptedClaims{}
+	for _, claim := range requiredClaims() {
+		claims[claim] = true
+	}
+	return claims
+}
+
+// newTestReconciler returns a reconciler backed by a fake client holding the objects,
+// which supports server-side apply and the cache indexes of the controller.
+func newTestReconciler(t *testing.T, config *ConfigStore, objs ...client.Object) *SettingsReconciler {
+	scheme := newTestScheme(t)
+	c := &indexedClient{
+		Client:  &applyClient{fake.NewClientBuilder().WithScheme(scheme).WithObjects(objs...).Build()},
+		indexes: map[string]client.IndexerFunc{APIBindingExportIndex: indexAPIBindingExport},
+	}
+	return &SettingsReconciler{Client: c, Scheme: scheme, CtrlConfig: config}
+}
+
+// controlledBy returns the object with the APIBinding set as its controller.
+func controlledBy(t *testing.T, ab *apisv1alpha1.APIBinding, obj client.Object) client.Object {
+	if err := ctrl.SetControllerReference(ab, obj, newTestScheme(t)); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+// indexedClient filters the objects listed with field selectors through the index functions
+// registered by the controller, which the fake client ignores.
+type indexedClient struct {
+	client.Client
+	indexes map[string]client.IndexerFunc
+}
+
+func (c *indexedClient) List(ctx context.Context, list client.ObjectList, opts ...client.ListOption) error {
+	if err := c.Client.List(ctx, list, opts...); err != nil {
+		return err
+	}
+	listOpts := (&client.ListOptions{}).ApplyOptions(opts)
+	if listOpts.FieldSelector == nil || listOpts.FieldSelector.Empty() {
+		return nil
+	}
+	objs, err := meta.ExtractList(list)
+	if err != nil {
+		return err
+	}
+	var matching []runtime.Object
+	for _, o := range objs {
+		ok, err := c.matches(o.(client.Object), listOpts.FieldSelector.Requirements())
+		if err != nil {
+			return err
+		}
+		if ok {
+			matching = append(matching, o)
+		}
+	}
+	return meta.SetList(list, matching)
+}
+
+func (c *indexedClient) matches(obj client.Object, requirements fields.Requirements) (bool, error) {
+	for _, requirement := range requirements {
+		index, ok := c.indexes[requirement.Field]
+		if !ok {
+			return false, fmt.Errorf("no index for the field %q", requirement.Field)
+		}
+		found := false
+		for _, value := range index(obj) {
+			found = found || value == requirement.Value
+		}
+		if !found {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// takeEvents returns the type, the reason and the message of the events created with the client
+// and deletes them, so that the next call only returns the events recorded in the meantime.
+func takeEvents(t *testing.T, c client.Client) []string {
+	t.Helper()
+	var list corev1.EventList
+	if err := c.List(context.Background(), &list); err != nil {
+		t.Fatalf("unable to list the events: %v", err)
+	}
+	var events []string
+	for i := range list.Items {
+		e := &list.Items[i]
+		events = append(events, fmt.Sprintf("%s %s %s", e.Type, e.Reason, e.Message))
+		if err := c.Delete(context.Background(), e); err != nil {
+			t.Fatalf("unable to delete the event %q: %v", e.Name, err)
+		}
+	}
+	return events
+}
+
+// newTestWorkspaces replaces the workspace tracker shared by the reconcilers with an empty one
+// for the duration of the test.
+func newTestWorkspaces(t *testing.T) *workspaceTracker {
+	saved := workspaces
+	workspaces = &workspaceTracker{states: map[workspaceKey]workspaceState{}}
+	t.Cleanup(func() { workspaces = saved })
+	return workspaces
+}
+
+// validConfig returns a minimal valid configuration.
+func validConfig() settingsv1alpha1.SettingsConfig {
+	return settingsv1alpha1.SettingsConfig{
+		Namespace: "pipelines",
+		NetPolConfig: settingsv1alpha1.SettingsNetPolConfig{
+			Spec: netv1.NetworkPolicySpec{PodSelector: metav1.LabelSelector{MatchLabels: map[string]string{"app": "build"}}},
+		},
+		QuotaConfig: settingsv1alpha1.SettingsQuotaConfig{
+			Spec: corev1.ResourceQuotaSpec{Hard: resourceList("count/pipelineruns.tekton.dev", "100")},
+		},
+	}
+}
+
+// resourceList parses pairs of resource names and quantities.
+func resourceList(pairs ...string) corev1.ResourceList {
+	list := corev1.ResourceList{}
+	for i := 0; i < len(pairs); i += 2 {
+		list[corev1.ResourceName(pairs[i])] = resource.MustParse(pairs[i+1])
+	}
+	return list
+}
+
+// applyClient emulates server-side apply, which the fake client does not support.
+// Field ownership is tracked on the spec, the labels, the annotations and the owner references:
+// maps are traversed while lists and scalars are owned as a whole. The owners are recorded
+// in the managed fields of the objects. Creates, updates and merge patches give the ownership
+// of the fields they change to their field manager, applies return a conflict when they change
+// a field owned by another manager, unless ownership is forced.
+type applyClient struct {
+	client.Client
+}
+
+// defaultFieldManager is used, like the user agent by the API server, when no field manager is specified.
+const defaultFieldManager = "manager"
+
+func (c *applyClient) Create(ctx context.Context, obj client.Object, opts ...client.CreateOption) error {
+	createOpts := &client.CreateOptions{}
+	createOpts.ApplyOptions(opts)
+	if err := c.Client.Create(ctx, obj, opts...); err != nil {
+		return err
+	}
+	return c.track(ctx, obj, nil, createOpts.FieldManager)
+}
+
+func (c *applyClient) Update(ctx context.Context, obj client.Object, opts ...client.UpdateOption) error {
+	updateOpts := &client.UpdateOptions{}
+	updateOpts.ApplyOptions(opts)
+	before := obj.DeepCopyObject().(client.Object)
+	if err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), before); err != nil {
+		return err
+	}
+	if err := c.Client.Update(ctx, obj, opts...); err != nil {
+		return err
+	}
+	return c.track(ctx, obj, before, updateOpts.FieldManager)
+}
+
+func (c *applyClient) Patch(ctx context.Context, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	patchOpts := &client.PatchOptions{}
+	patchOpts.ApplyOptions(opts)
+	if patch == client.Apply {
+		return c.apply(ctx, obj, patchOpts.FieldManager, patchOpts.Force != nil && *patchOpts.Force)
+	}
+	before := obj.DeepCopyObject().(client.Object)
+	if err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), before); err != nil {
+		return err
+	}
+	if err := c.Client.Patch(ctx, obj, patch, opts...); err != nil {
+		return err
+	}
+	return c.track(ctx, obj, before, patchOpts.FieldManager)
+}
+
+// track gives the ownership of the fields changed by a create, an update or a patch to the field manager.
+func (c *applyClient) track(ctx context.Context, obj, before client.Object, manager string) error {
+	if manager == "" {
+		manager = defaultFieldManager
+	}
+	previous := map[string]interface{}{}
+	owners := fieldOwners{}
+	if before != nil {
+		previous = managedLeaves(before)
+		owners = ownersOf(before)
+	}
+	current := managedLeaves(obj)
+	for path := range previous {
+		if _, ok := current[path]; !ok {
+			delete(owners, path)
+		}
+	}
+	for path, value := range current {
+		if old, ok := previous[path]; !ok || !reflect.DeepEqual(old, value) {
+			owners[path] = map[string]metav1.ManagedFieldsOperationType{manager: metav1.ManagedFieldsOperationUpdate}
+		}
+	}
+	if reflect.DeepEqual(owners, ownersOf(obj)) {
+		return nil
+	}
+	obj.SetManagedFields(owners.managedFields())
+	return c.Client.Update(ctx, obj)
+}
+
+// apply merges the fields set in the object into the live one and takes their ownership.
+func (c *applyClient) apply(ctx context.Context, obj client.Object, manager string, force bool) error {
+	live := obj.DeepCopyObject().(client.Object)
+	if err := c.Client.Get(ctx, client.ObjectKeyFromObject(obj), live); err != nil {
+		if !errors.IsNotFound(err) {
+			return err
+		}
+		owners := fieldOwners{}
+		for path := range managedLeaves(obj) {
+			owners[path] = map[string]metav1.ManagedFieldsOperationType{manager: metav1.ManagedFieldsOperationApply}
+		}
+		obj.SetManagedFields(owners.managedFields())
+		return c.Client.Create(ctx, obj)
+	}
+
+	applied := managedLeaves(obj)
+	current := managedLeaves(live)
+	owners := ownersOf(live)
+	var causes []metav1.StatusCause
+	for path, value := range applied {
+		if old, ok := current[path]; !ok || reflect.DeepEqual(old, value) {
+			continue
+		}
+		for other := range owners[path] {
+			if other != manager {
+				causes = append(causes, metav1.StatusCause{
+					Type:    metav1.CauseTypeFieldManagerConflict,
+					Message: fmt.Sprintf("conflict with %q", other),
+					Field:   displayPath(path),
+				})
+			}
+		}
+	}
+	if len(causes) > 0 && !force {
+		sort.Slice(causes, func(i, j int) bool { return causes[i].Field < causes[j].Field })
+		return errors.NewApplyConflict(causes, fmt.Sprintf("Apply failed with %d conflicts", len(causes)))
+	}
+
+	// The fields previously applied by the manager and not part of the object anymore are removed,
+	// unless another manager owns them.
+	for path, managers := range owners {
+		if _, ok := applied[path]; ok || managers[manager] != metav1.ManagedFieldsOperationApply {
+			continue
+		}
+		delete(managers, manager)
+		if len(managers) == 0 {
+			delete(owners, path)
+			delete(current, path)
+		}
+	}
+	for path, value := range applied {
+		if old, ok := current[path]; !ok || !reflect.DeepEqual(old, value) || owners[path] == nil {
+			owners[path] = map[string]metav1.ManagedFieldsOperationType{}
+		}
+		owners[path][manager] = metav1.ManagedFieldsOperationApply
+		current[path] = value
+	}
+
+	if reflect.DeepEqual(current, managedLeaves(live)) && reflect.DeepEqual(owners, ownersOf(live)) {
+		return c.Client.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+	}
+	merged, err := withManagedLeaves(live, current)
+	if err != nil {
+		return err
+	}
+	merged.SetManagedFields(owners.managedFields())
+	if err := c.Client.Update(ctx, merged); err != nil {
+		return err
+	}
+	return c.Client.Get(ctx, client.ObjectKeyFromObject(obj), obj)
+}
+
+// fieldOwners maps the paths of the managed fields to their field managers and the operations they used.
+type fieldOwners map[string]map[string]metav1.ManagedFieldsOperationType
+
+// pathSeparator separates the segments of the field paths, which may contain dots and slashes.
+const pathSeparator = "\x00"
+
+func displayPath(path string) string {
+	return "." + strings.ReplaceAll(path, pathSeparator, ".")
+}
+
+// managedFields encodes the owners as managed fields entries, with one entry per manager and operation.
+func (o fieldOwners) managedFields() []metav1.ManagedFieldsEntry {
+	sets := map[metav1.ManagedFieldsEntry]map[string]interface{}{}
+	for path, managers := range o {
+		for manager, operation := range managers {
+			key := metav1.ManagedFieldsEntry{Manager: manager, Operation: operation}
+			if sets[key] == nil {
+				sets[key] = map[string]interface{}{}
+			}
+			set := sets[key]
+			segments := strings.Split(path, pathSeparator)
+			for _, segment := range segments {
+				if set["f:"+segment] == nil {
+					set["f:"+segment] = map[string]interface{}{}
+				}
+				set = set["f:"+segment].(map[string]interface{})
+			}
+		}
+	}
+	var entries []metav1.ManagedFieldsEntry
+	for entry, set := range sets {
+		raw, _ := json.Marshal(set)
+		entry.FieldsType = "FieldsV1"
+		entry.FieldsV1 = &metav1.FieldsV1{Raw: raw}
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Manager+string(entries[i].Operation) < entries[j].Manager+string(entries[j].Operation)
+	})
+	return entries
+}
+
+// ownersOf decodes the managed fields of the object.
+func ownersOf(obj client.Object) fieldOwners {
+	owners := fieldOwners{}
+	for _, entry := range obj.GetManagedFields() {
+		if entry.FieldsV1 == nil {
+			continue
+		}
+		var set map[string]interface{}
+		if err := json.Unmarshal(entry.FieldsV1.Raw, &set); err != nil {
+			continue
+		}
+		var walk func(prefix []string, set map[string]interface{})
+		walk = func(prefix []string, set map[string]interface{}) {
+			if len(set) == 0 {
+				path := strings.Join(prefix, pathSeparator)
+				if owners[path] == nil {
+					owners[path] = map[string]metav1.ManagedFieldsOperationType{}
+				}
+				owners[path][entry.Manager] = entry.Operation
+				return
+			}
+			for key, child := range set {
+				childSet, _ := child.(map[string]interface{})
+				walk(append(append([]string{}, prefix...), strings.TrimPrefix(key, "f:")), childSet)
+			}
+		}
+		walk(nil, set)
+	}
+	return owners
+}
+
+// managedLeaves returns the values of the fields, which ownership is tracked, indexed by their paths.
+// Owner references are indexed by their UIDs.
+func managedLeaves(obj client.Object) map[string]interface{} {
+	u, _ := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	metadata := map[string]interface{}{}
+	if labels := obj.GetLabels(); len(labels) > 0 {
+		metadata["labels"] = toInterfaceMap(labels)
+	}
+	if annotations := obj.GetAnnotations(); len(annotations) > 0 {
+		metadata["annotations"] = toInterfaceMap(annotations)
+	}
+	if refs := obj.GetOwnerReferences(); len(refs) > 0 {
+		byUID := map[string]interface{}{}
+		for _, ref := range refs {
+			refMap, _ := runtime.DefaultUnstructuredConverter.ToUnstructured(ref.DeepCopy())
+			byUID[string(ref.UID)] = refMap
+		}
+		metadata["ownerReferences"] = byUID
+	}
+	leaves := map[string]interface{}{}
+	var walk func(prefix []string, value interface{})
+	walk = func(prefix []string, value interface{}) {
+		if m, ok := value.(map[string]interface{}); ok {
+			for key, child := range m {
+				walk(append(append([]string{}, prefix...), key), child)
+			}
+			return
+		}
+		if value != nil {
+			leaves[strings.Join(prefix, pathSeparator)] = value
+		}
+	}
+	walk([]string{"metadata"}, metadata)
+	walk([]string{"spec"}, u["spec"])
+	return leaves
+}
+
+// withManagedLeaves returns a copy of the object with the managed fields replaced by the leaves.
+func withManagedLeaves(obj client.Object, leaves map[string]interface{}) (client.Object, error) {
+	u, err := runtime.DefaultUnstructuredConverter.ToUnstructured(obj)
+	if err != nil {
+		return nil, err
+	}
+	tree := map[string]interface{}{}
+	for path, value := range leaves {
+		segments := strings.Split(path, pathSeparator)
+		node := tree
+		for _, segment := range segments[:len(segments)-1] {
+			if node[segment] == nil {
+				node[segment] = map[string]interface{}{}
+			}
+			node = node[segment].(map[string]interface{})
+		}
+		node[segments[len(segments)-1]] = value
+	}
+	metadata, _ := tree["metadata"].(map[string]interface{})
+	objMeta := u["metadata"].(map[string]interface{})
+	for _, field := range []string{"labels", "annotations"} {
+		if metadata[field] != nil {
+			objMeta[field] = metadata[field]
+		} else {
+			delete(objMeta, field)
+		}
+	}
+	var refs []interface{}
+	if byUID, ok := metadata["ownerReferences"].(map[string]interface{}); ok {
+		// The order of the existing references is kept.
+		for _, ref := range obj.GetOwnerReferences() {
+			if refMap, ok := byUID[string(ref.UID)]; ok {
+				refs = append(refs, refMap)
+				delete(byUID, string(ref.UID))
+			}
+		}
+		for _, uid := range sortedKeys(byUID) {
+			refs = append(refs, byUID[uid])
+		}
+	}
+	if len(refs) > 0 {
+		objMeta["ownerReferences"] = refs
+	} else {
+		delete(objMeta, "ownerReferences")
+	}
+	if tree["spec"] != nil {
+		u["spec"] = tree["spec"]
+	} else {
+		delete(u, "spec")
+	}
+
+	merged := obj.DeepCopyObject().(client.Object)
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u, merged); err != nil {
+		return nil, err
+	}
+	return merged, nil
+}
+
+func toInterfaceMap(m map[string]string) map[string]interface{} {
+	result := map[string]interface{}{}
+	for k, v := range m {
+		result[k] = v
+	}
+	return result
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	var keys []string
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// sameElements returns true if both lists contain the same elements, whatever their order.
+func sameElements(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	counts := map[string]int{}
+	for _, e := range a {
+		counts[e]++
+	}
+	for _, e := range b {
+		if counts[e] == 0 {
+			return false
+		}
+		counts[e]--
+	}
+	return true
+}
@@ -0,0 +1,91 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// IdentityHashes returns the identity hashes of the claimed resources, which are bound by the APIBinding,
+// the kubernetes APIBinding for instance, indexed by group and resource. Only the claims on resources,
+// which are not served by kcp itself, need an identity hash: the APIBinding is not looked up when there is none.
+// An error is returned for each of these claims, whose resource is not bound by the APIBinding.
+func IdentityHashes(ctx context.Context, c client.Reader, bindingName string, claims []apisv1alpha1.PermissionClaim) (map[apisv1alpha1.GroupResource]string, error) {
+	hashes := map[apisv1alpha1.GroupResource]string{}
+	var needed []apisv1alpha1.GroupResource
+	for _, claim := range claims {
+		if !builtIn(claim.GroupResource) {
+			needed = append(needed, claim.GroupResource)
+		}
+	}
+	if len(needed) == 0 {
+		return hashes, nil
+	}
+
+	var ab apisv1alpha1.APIBinding
+	if err := c.Get(ctx, types.NamespacedName{Name: bindingName}, &ab); err != nil {
+		return nil, fmt.Errorf("error getting APIBinding %q: %w", bindingName, err)
+	}
+	bound := map[apisv1alpha1.GroupResource]string{}
+	for _, br := range ab.Status.BoundResources {
+		bound[apisv1alpha1.GroupResource{Group: br.Group, Resource: br.Resource}] = br.Schema.IdentityHash
+	}
+	var errs []error
+	for _, gr := range needed {
+		if _, done := hashes[gr]; done {
+			continue
+		}
+		identityHash, ok := bound[gr]
+		if !ok {
+			errs = append(errs, fmt.Errorf("%s is not bound by APIBinding %q", claimName(gr), bindingName))
+			continue
+		}
+		hashes[gr] = identityHash
+	}
+	return hashes, kerrors.NewAggregate(errs)
+}
+
+// builtIn returns whether the resource is served by kcp itself, in which case a claim on it has no identity hash.
+func builtIn(gr apisv1alpha1.GroupResource) bool {
+	return gr.Group == "" || strings.HasSuffix(gr.Group, ".kcp.dev")
+}
+
+// VerifyPermissionClaims checks that the permission claims of the APIExport on the bound resources
+// carry their identity hashes and that the claims carrying an identity hash are on bound resources.
+// An error listing the diverging claims is returned otherwise.
+func VerifyPermissionClaims(apiExport *apisv1alpha1.APIExport, hashes map[apisv1alpha1.GroupResource]string) error {
+	var mismatches []string
+	for _, claim := range apiExport.Spec.PermissionClaims {
+		identityHash, ok := hashes[claim.GroupResource]
+		switch {
+		case !ok && claim.IdentityHash != "":
+			mismatches = append(mismatches, fmt.Sprintf("%s: identityHash is %q, the resource is not bound by the identity APIBinding", claimName(claim.GroupResource), claim.IdentityHash))
+		case ok && claim.IdentityHash != identityHash:
+			mismatches = append(mismatches, fmt.Sprintf("%s: identityHash is %q, expected %q", claimName(claim.GroupResource), claim.IdentityHash, identityHash))
+		}
+	}
+	if len(mismatches) > 0 {
+		return fmt.Errorf("permission claims of APIExport %q do not match the bound resources: %s", apiExport.Name, strings.Join(mismatches, "; "))
+	}
+	return nil
+}
+
+// PatchPermissionClaims sets the identity hashes of the bound resources on the permission claims of the APIExport.
+func PatchPermissionClaims(ctx context.Context, c client.Client, apiExport *apisv1alpha1.APIExport, hashes map[apisv1alpha1.GroupResource]string) error {
+	patch := client.MergeFrom(apiExport.DeepCopy())
+	for i, claim := range apiExport.Spec.PermissionClaims {
+		if identityHash, ok := hashes[claim.GroupResource]; ok {
+			apiExport.Spec.PermissionClaims[i].IdentityHash = identityHash
+		}
+	}
+	if err := c.Patch(ctx, apiExport, patch); err != nil {
+		return fmt.Errorf("error patching APIExport %q: %w", apiExport.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,162 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+var (
+	namespacesResource = apisv1alpha1.GroupResource{Resource: "namespaces"}
+	quotasResource     = apisv1alpha1.GroupResource{Resource: "resourcequotas"}
+	policiesResource   = apisv1alpha1.GroupResource{Group: "networking.k8s.io", Resource: "networkpolicies"}
+)
+
+func TestIdentityHashes(t *testing.T) {
+	deploymentsResource := apisv1alpha1.GroupResource{Group: "apps", Resource: "deployments"}
+	kubernetes := &apisv1alpha1.APIBinding{
+		ObjectMeta: metav1.ObjectMeta{Name: "kubernetes"},
+		Status: apisv1alpha1.APIBindingStatus{BoundResources: []apisv1alpha1.BoundAPIResource{
+			{Group: "networking.k8s.io", Resource: "networkpolicies", Schema: apisv1alpha1.BoundAPIResourceSchema{IdentityHash: "policies-hash"}},
+			{Group: "apps", Resource: "deployments", Schema: apisv1alpha1.BoundAPIResourceSchema{IdentityHash: "deployments-hash"}},
+		}},
+	}
+	tests := []struct {
+		name    string
+		binding string
+		claims  []apisv1alpha1.GroupResource
+		hashes  map[apisv1alpha1.GroupResource]string
+		// claims expected to be reported in the error
+		failed []string
+		err    bool
+	}{
+		{
+			name:    "claims needing an identity",
+			binding: "kubernetes",
+			claims:  []apisv1alpha1.GroupResource{namespacesResource, apiBindingsClaim, policiesResource, policiesResource},
+			hashes:  map[apisv1alpha1.GroupResource]string{policiesResource: "policies-hash"},
+		},
+		{
+			// The APIBinding is not needed for the resources served by kcp.
+			name:    "built-in resources only",
+			binding: "missing",
+			claims:  []apisv1alpha1.GroupResource{namespacesResource, quotasResource, apiBindingsClaim},
+			hashes:  map[apisv1alpha1.GroupResource]string{},
+		},
+		{
+			name:    "missing APIBinding",
+			binding: "missing",
+			claims:  []apisv1alpha1.GroupResource{policiesResource},
+			err:     true,
+		},
+		{
+			name:    "resources not bound",
+			binding: "kubernetes",
+			claims: []apisv1alpha1.GroupResource{
+				policiesResource,
+				{Group: "tekton.dev", Resource: "pipelineruns"},
+				deploymentsResource,
+				{Group: "tekton.dev", Resource: "taskruns"},
+			},
+			hashes: map[apisv1alpha1.GroupResource]string{policiesResource: "policies-hash", deploymentsResource: "deployments-hash"},
+			failed: []string{"pipelineruns.tekton.dev", "taskruns.tekton.dev"},
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newTestReconciler(t, nil, kubernetes)
+			var claims []apisv1alpha1.PermissionClaim
+			for _, claim := range tt.claims {
+				claims = append(claims, apisv1alpha1.PermissionClaim{GroupResource: claim})
+			}
+			hashes, err := IdentityHashes(context.Background(), r, tt.binding, claims)
+			if (err != nil) != tt.err {
+				t.Fatalf("IdentityHashes() error = %v, expected an error: %t", err, tt.err)
+			}
+			for _, name := range tt.failed {
+				if !strings.Contains(err.Error(), name) {
+					t.Errorf("the error does not report the claim %s: %v", name, err)
+				}
+			}
+			if tt.hashes != nil && !reflect.DeepEqual(hashes, tt.hashes) {
+				t.Errorf("IdentityHashes() = %v, expected %v", hashes, tt.hashes)
+			}
+		})
+	}
+}
+
+func TestVerifyPermissionClaims(t *testing.T) {
+	hashes := map[apisv1alpha1.GroupResource]string{quotasResource: "quotas-hash", policiesResource: "policies-hash"}
+	tests := []struct {
+		name   string
+		claims []apisv1alpha1.PermissionClaim
+		err    bool
+	}{
+		{
+			name: "matching identity hashes",
+			claims: []apisv1alpha1.PermissionClaim{
+				{GroupResource: namespacesResource},
+				{GroupResource: quotasResource, IdentityHash: "quotas-hash"},
+				{GroupResource: policiesResource, IdentityHash: "policies-hash"},
+			},
+		},
+		{
+			name:   "missing identity hash",
+			claims: []apisv1alpha1.PermissionClaim{{GroupResource: quotasResource}},
+			err:    true,
+		},
+		{
+			name:   "diverging identity hash",
+			claims: []apisv1alpha1.PermissionClaim{{GroupResource: policiesResource, IdentityHash: "stale-hash"}},
+			err:    true,
+		},
+		{
+			name:   "identity hash on a resource not bound",
+			claims: []apisv1alpha1.PermissionClaim{{GroupResource: namespacesResource, IdentityHash: "other-hash"}},
+			err:    true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			apiExport := &apisv1alpha1.APIExport{Spec: apisv1alpha1.APIExportSpec{PermissionClaims: tt.claims}}
+			if err := VerifyPermissionClaims(apiExport, hashes); (err != nil) != tt.err {
+				t.Errorf("VerifyPermissionClaims() error = %v, expected an error: %t", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestPatchPermissionClaims(t *testing.T) {
+	apiExport := &apisv1alpha1.APIExport{
+		ObjectMeta: metav1.ObjectMeta{Name: testExportName},
+		Spec: apisv1alpha1.APIExportSpec{PermissionClaims: []apisv1alpha1.PermissionClaim{
+			{GroupResource: namespacesResource},
+			{GroupResource: quotasResource, IdentityHash: "stale-hash"},
+			{GroupResource: policiesResource},
+		}},
+	}
+	r := newTestReconciler(t, nil, apiExport)
+	hashes := map[apisv1alpha1.GroupResource]string{quotasResource: "quotas-hash", policiesResource: "policies-hash"}
+
+	ctx := context.Background()
+	if err := PatchPermissionClaims(ctx, r.Client, apiExport, hashes); err != nil {
+		t.Fatal(err)
+	}
+	var patched apisv1alpha1.APIExport
+	if err := r.Get(ctx, types.NamespacedName{Name: testExportName}, &patched); err != nil {
+		t.Fatal(err)
+	}
+	if err := VerifyPermissionClaims(&patched, hashes); err != nil {
+		t.Errorf("the patched claims do not match the bound resources: %v", err)
+	}
+	if claim := patched.Spec.PermissionClaims[0]; claim.IdentityHash != "" {
+		t.Errorf("an identity hash has been set on the claim of a resource not bound: %+v", claim)
+	}
+}
@@ -0,0 +1,244 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/apiutil"
+	cutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// inventory collects the resources managed in a workspace during a reconciliation.
+// The resources of the previous inventory, which are not part of the desired state anymore, are stale.
+type inventory struct {
+	previous map[string]settingsv1alpha1.ManagedResource
+	current  map[string]settingsv1alpha1.ManagedResource
+}
+
+func newInventory(previous []settingsv1alpha1.ManagedResource) *inventory {
+	inv := &inventory{
+		previous: map[string]settingsv1alpha1.ManagedResource{},
+		current:  map[string]settingsv1alpha1.ManagedResource{},
+	}
+	for _, res := range previous {
+		inv.previous[resourceKey(res.Group, res.Kind, res.Namespace, res.Name)] = res
+	}
+	return inv
+}
+
+func resourceKey(group, kind, namespace, name string) string {
+	return strings.Join([]string{group, kind, namespace, name}, "/")
+}
+
+// add records a resource of the desired state, whether it could be applied or not.
+// The previous hash and sync time are kept till the resource gets synced.
+func (i *inventory) add(group, kind, namespace, name string) {
+	key := resourceKey(group, kind, namespace, name)
+	res := settingsv1alpha1.ManagedResource{Group: group, Kind: kind, Namespace: namespace, Name: name}
+	if previous, ok := i.previous[key]; ok {
+		res.Hash = previous.Hash
+		res.LastSyncTime = previous.LastSyncTime
+	}
+	i.current[key] = res
+}
+
+// synced records the hash of the desired state, which has been successfully applied to the resource.
+// The sync time is updated when the resource has been created or updated, or when it was not recorded yet:
+// the status may not have been saved after the creation.
+func (i *inventory) synced(group, kind, namespace, name, hash string, result cutil.OperationResult) {
+	key := resourceKey(group, kind, namespace, name)
+	res, ok := i.current[key]
+	if !ok {
+		return
+	}
+	res.Hash = hash
+	if result != cutil.OperationResultNone || res.LastSyncTime.IsZero() {
+		now := metav1.Now()
+		res.LastSyncTime = &now
+	}
+	i.current[key] = res
+}
+
+// carry keeps the previous resources of the kind, which could not be reconciled,
+// because the permission claim has not been accepted for instance, so that they are not pruned.
+func (i *inventory) carry(group, kind string) {
+	for key, res := range i.previous {
+		if res.Group == group && res.Kind == kind {
+			i.current[key] = res
+		}
+	}
+}
+
+// retain keeps a stale resource, which could not be pruned, in the inventory.
+func (i *inventory) retain(res settingsv1alpha1.ManagedResource) {
+	i.current[resourceKey(res.Group, res.Kind, res.Namespace, res.Name)] = res
+}
+
+// stale returns the resources of the previous inventory, which are not part of the desired state anymore.
+func (i *inventory) stale() []settingsv1alpha1.ManagedResource {
+	var stale []settingsv1alpha1.ManagedResource
+	for key, res := range i.previous {
+		if _, ok := i.current[key]; !ok {
+			stale = append(stale, res)
+		}
+	}
+	sortResources(stale)
+	return stale
+}
+
+// resources returns the inventory, sorted so that the status does not change between reconciliations.
+func (i *inventory) resources() []settingsv1alpha1.ManagedResource {
+	var resources []settingsv1alpha1.ManagedResource
+	for _, res := range i.current {
+		resources = append(resources, res)
+	}
+	sortResources(resources)
+	return resources
+}
+
+func sortResources(resources []settingsv1alpha1.ManagedResource) {
+	sort.Slice(resources, func(a, b int) bool {
+		return resourceKey(resources[a].Group, resources[a].Kind, resources[a].Namespace, resources[a].Name) <
+			resourceKey(resources[b].Group, resources[b].Kind, resources[b].Namespace, resources[b].Name)
+	})
+}
+
+// discoverManagedResources returns the resources controlled by the APIBinding in the namespace.
+// It bootstraps the inventory of the workspaces managed before it was recorded in the Settings status.
+func (r *SettingsReconciler) discoverManagedResources(ctx context.Context, ab *apisv1alpha1.APIBinding, namespace string, claims acceptedClaims) ([]settingsv1alpha1.ManagedResource, error) {
+	var resources []settingsv1alpha1.ManagedResource
+
+	if claims[namespacesClaim] {
+		var ns corev1.Namespace
+		if err := r.getLive(ctx, "", namespace, &ns); err != nil {
+			return nil, err
+		}
+		if metav1.IsControlledBy(&ns, ab) {
+			resources = append(resources, settingsv1alpha1.ManagedResource{Kind: "Namespace", Name: namespace})
+		}
+	}
+
+	for _, list := range managedLists(claims) {
+		if err := r.List(ctx, list, client.InNamespace(namespace)); err != nil {
+			return nil, fmt.Errorf("unable to list the managed resources: %w", err)
+		}
+		objs, err := meta.ExtractList(list)
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range objs {
+			obj, ok := o.(client.Object)
+			if !ok || !metav1.IsControlledBy(obj, ab) {
+				continue
+			}
+			gvk, err := apiutil.GVKForObject(obj, r.Scheme)
+			if err != nil {
+				return nil, err
+			}
+			resources = append(resources, settingsv1alpha1.ManagedResource{
+				Group:     gvk.Group,
+				Kind:      gvk.Kind,
+				Namespace: obj.GetNamespace(),
+				Name:      obj.GetName(),
+				Hash:      obj.GetAnnotations()[DesiredHashAnnotation],
+			})
+		}
+	}
+	return resources, nil
+}
+
+// pruneStale deletes the stale resources, which are still controlled by the APIBinding.
+// A namespace is never deleted as it would delete its content: it is released instead.
+// The resources, which could not be pruned, are returned so that pruning is retried.
+func (r *SettingsReconciler) pruneStale(ctx context.Context, ab *apisv1alpha1.APIBinding, stale []settingsv1alpha1.ManagedResource, events *settingsEvents) ([]settingsv1alpha1.ManagedResource, error) {
+	logger := ctrl.LoggerFrom(ctx)
+
+	var failed []settingsv1alpha1.ManagedResource
+	var errs []error
+	for _, res := range stale {
+		obj, err := r.newObject(res.Group, res.Kind)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := r.Get(ctx, types.NamespacedName{Namespace: res.Namespace, Name: res.Name}, obj); err != nil {
+			if !errors.IsNotFound(err) {
+				failed = append(failed, res)
+				errs = append(errs, fmt.Errorf("unable to get %q: %w", res.Name, err))
+			}
+			continue
+		}
+		if !metav1.IsControlledBy(obj, ab) {
+			continue
+		}
+		if res.Kind == "Namespace" {
+			if err := r.releaseNamespace(ctx, ab, obj); err != nil {
+				failed = append(failed, res)
+				errs = append(errs, err)
+				continue
+			}
+			logger.V(1).Info("Orphaned namespace no longer in the configuration", "name", res.Name)
+			events.orphaned(res.Kind, res.Name)
+			continue
+		}
+		if err := r.Delete(ctx, obj); err != nil && !errors.IsNotFound(err) {
+			failed = append(failed, res)
+			errs = append(errs, fmt.Errorf("unable to delete %q: %w", res.Name, err))
+			continue
+		}
+		logger.V(1).Info("Pruned object no longer in the configuration", "kind", res.Kind, "namespace", res.Namespace, "name", res.Name)
+		events.deleted(res.Kind, res.Name)
+	}
+	return failed, kerrors.NewAggregate(errs)
+}
+
+// releaseNamespace removes the owner reference of the APIBinding and the label of the controller from the namespace
+// so that it is not adopted again if it gets configured later on.
+func (r *SettingsReconciler) releaseNamespace(ctx context.Context, ab *apisv1alpha1.APIBinding, ns client.Object) error {
+	var refs []metav1.OwnerReference
+	for _, ref := range ns.GetOwnerReferences() {
+		if ref.UID != ab.GetUID() {
+			refs = append(refs, ref)
+		}
+	}
+	labels := ns.GetLabels()
+	if _, ok := labels[ManagedByLabel]; !ok && len(refs) == len(ns.GetOwnerReferences()) {
+		return nil
+	}
+
+	patch := client.MergeFrom(ns.DeepCopyObject().(client.Object))
+	delete(labels, ManagedByLabel)
+	ns.SetLabels(labels)
+	ns.SetOwnerReferences(refs)
+	if err := r.Patch(ctx, ns, patch); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("unable to orphan %q: %w", ns.GetName(), err)
+	}
+	return nil
+}
+
+// newObject returns an empty object of the kind.
+func (r *SettingsReconciler) newObject(group, kind string) (client.Object, error) {
+	for _, gv := range r.Scheme.PrioritizedVersionsForGroup(group) {
+		o, err := r.Scheme.New(gv.WithKind(kind))
+		if err != nil {
+			continue
+		}
+		if obj, ok := o.(client.Object); ok {
+			return obj, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown kind %q in group %q", kind, group)
+}
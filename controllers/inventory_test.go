@@ -0,0 +1,236 @@
+package controllers
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	cutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+func TestInventoryStale(t *testing.T) {
+	ns := settingsv1alpha1.ManagedResource{Kind: "Namespace", Name: "pipelines"}
+	np := settingsv1alpha1.ManagedResource{Group: netv1.GroupName, Kind: "NetworkPolicy", Namespace: "pipelines", Name: NpName}
+	qt := settingsv1alpha1.ManagedResource{Kind: "ResourceQuota", Namespace: "pipelines", Name: QtName}
+	lr := settingsv1alpha1.ManagedResource{Kind: "LimitRange", Namespace: "pipelines", Name: LrName}
+
+	tests := []struct {
+		name     string
+		previous []settingsv1alpha1.ManagedResource
+		update   func(*inventory)
+		stale    []settingsv1alpha1.ManagedResource
+	}{
+		{
+			name:   "no previous inventory",
+			update: func(i *inventory) { i.add("", "Namespace", "", "pipelines") },
+		},
+		{
+			name:     "all resources desired",
+			previous: []settingsv1alpha1.ManagedResource{ns, np},
+			update: func(i *inventory) {
+				i.add("", "Namespace", "", "pipelines")
+				i.add(netv1.GroupName, "NetworkPolicy", "pipelines", NpName)
+			},
+		},
+		{
+			name:     "resources not desired anymore",
+			previous: []settingsv1alpha1.ManagedResource{lr, np, ns, qt},
+			update:   func(i *inventory) { i.add("", "Namespace", "", "pipelines") },
+			stale:    []settingsv1alpha1.ManagedResource{lr, qt, np},
+		},
+		{
+			name:     "carried resources",
+			previous: []settingsv1alpha1.ManagedResource{ns, np, qt},
+			update: func(i *inventory) {
+				i.add("", "Namespace", "", "pipelines")
+				i.carry(netv1.GroupName, "NetworkPolicy")
+			},
+			stale: []settingsv1alpha1.ManagedResource{qt},
+		},
+		{
+			name:     "retained resources",
+			previous: []settingsv1alpha1.ManagedResource{ns, qt},
+			update:   func(i *inventory) { i.retain(qt) },
+			stale:    []settingsv1alpha1.ManagedResource{ns},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := newInventory(tt.previous)
+			tt.update(inv)
+			if stale := inv.stale(); !reflect.DeepEqual(stale, tt.stale) {
+				t.Errorf("stale() = %+v, expected %+v", stale, tt.stale)
+			}
+		})
+	}
+}
+
+func TestInventorySynced(t *testing.T) {
+	lastSync := metav1.NewTime(time.Now().Add(-time.Hour).Truncate(time.Second))
+	previous := settingsv1alpha1.ManagedResource{Kind: "ResourceQuota", Namespace: "pipelines", Name: QtName, Hash: "old", LastSyncTime: &lastSync}
+
+	tests := []struct {
+		name     string
+		previous []settingsv1alpha1.ManagedResource
+		// result of the apply, the resource is not synced when empty
+		result  cutil.OperationResult
+		hash    string
+		updated bool
+	}{
+		{name: "new resource not applied"},
+		{name: "new resource created", result: cutil.OperationResultCreated, hash: "new", updated: true},
+		// The status has not been saved after the creation.
+		{name: "new resource unchanged", result: cutil.OperationResultNone, hash: "new", updated: true},
+		{name: "not applied", previous: []settingsv1alpha1.ManagedResource{previous}, hash: "old"},
+		{name: "unchanged", previous: []settingsv1alpha1.ManagedResource{previous}, result: cutil.OperationResultNone, hash: "new"},
+		{name: "updated", previous: []settingsv1alpha1.ManagedResource{previous}, result: cutil.OperationResultUpdated, hash: "new", updated: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			inv := newInventory(tt.previous)
+			inv.add("", "ResourceQuota", "pipelines", QtName)
+			if tt.result != "" {
+				inv.synced("", "ResourceQuota", "pipelines", QtName, "new", tt.result)
+			}
+			resources := inv.resources()
+			if len(resources) != 1 {
+				t.Fatalf("expected a single resource, got %+v", resources)
+			}
+			if resources[0].Hash != tt.hash {
+				t.Errorf("hash is %q, expected %q", resources[0].Hash, tt.hash)
+			}
+			var expected *metav1.Time
+			if tt.previous != nil {
+				expected = &lastSync
+			}
+			if updated := !resources[0].LastSyncTime.Equal(expected); updated != tt.updated {
+				t.Errorf("last sync time %v, expected to be updated: %t", resources[0].LastSyncTime, tt.updated)
+			}
+			// A resource never synced is recorded without sync time rather than with a null one.
+			if resources[0].LastSyncTime == nil {
+				content, err := json.Marshal(resources[0])
+				if err != nil {
+					t.Fatal(err)
+				}
+				if strings.Contains(string(content), "lastSyncTime") {
+					t.Errorf("the resource is serialized with a sync time: %s", content)
+				}
+			}
+		})
+	}
+}
+
+func TestPruneStale(t *testing.T) {
+	ab := newTestAPIBinding()
+	other := &apisv1alpha1.APIBinding{ObjectMeta: metav1.ObjectMeta{Name: "other", UID: "other-uid"}}
+	stale := []settingsv1alpha1.ManagedResource{
+		{Kind: "Namespace", Name: "old"},
+		{Kind: "ResourceQuota", Namespace: "pipelines", Name: "foreign"},
+		{Kind: "ResourceQuota", Namespace: "pipelines", Name: "gone"},
+		{Kind: "ResourceQuota", Namespace: "pipelines", Name: "stale"},
+	}
+
+	r := newTestReconciler(t, nil, ab,
+		controlledBy(t, ab, &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "old", Labels: map[string]string{ManagedByLabel: FieldManager}}}),
+		controlledBy(t, ab, &corev1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Namespace: "pipelines", Name: "stale"}}),
+		controlledBy(t, other, &corev1.ResourceQuota{ObjectMeta: metav1.ObjectMeta{Namespace: "pipelines", Name: "foreign"}}),
+	)
+	ctx := context.Background()
+	settings := &settingsv1alpha1.Settings{ObjectMeta: metav1.ObjectMeta{Name: SettingName}}
+	events := r.newSettingsEvents(ctx, settings, acceptedClaims{eventsClaim: true})
+	failed, err := r.pruneStale(ctx, ab, stale, events)
+	if err != nil || len(failed) > 0 {
+		t.Fatalf("pruneStale() failed on %+v: %v", failed, err)
+	}
+
+	// The namespace is kept but released so that it is not adopted again.
+	var ns corev1.Namespace
+	if err := r.Get(ctx, types.NamespacedName{Name: "old"}, &ns); err != nil {
+		t.Fatalf("the namespace has been deleted: %v", err)
+	}
+	if len(ns.GetOwnerReferences()) > 0 {
+		t.Errorf("the namespace has not been orphaned: %+v", ns.GetOwnerReferences())
+	}
+	if _, ok := ns.GetLabels()[ManagedByLabel]; ok {
+		t.Errorf("the label of the controller has not been removed: %v", ns.GetLabels())
+	}
+	// The stale quota is deleted and the quota controlled by another APIBinding is left untouched.
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "pipelines", Name: "stale"}, &corev1.ResourceQuota{}); !errors.IsNotFound(err) {
+		t.Errorf("the stale quota has not been deleted: %v", err)
+	}
+	if err := r.Get(ctx, types.NamespacedName{Namespace: "pipelines", Name: "foreign"}, &corev1.ResourceQuota{}); err != nil {
+		t.Errorf("the quota controlled by another APIBinding has been deleted: %v", err)
+	}
+
+	expected := []string{`Normal NamespaceOrphaned Namespace "old" orphaned`, `Normal ResourceQuotaDeleted ResourceQuota "stale" deleted`}
+	if recorded := takeEvents(t, r.Client); !sameElements(recorded, expected) {
+		t.Errorf("recorded events %q, expected %q", recorded, expected)
+	}
+}
+
+func TestReconcilePrunesStaleResources(t *testing.T) {
+	rt := newReconcileTest(t, managedConfig("100"), requiredClaims())
+	_, s, err := rt.reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	var kinds []string
+	for _, res := range s.Status.ManagedResources {
+		kinds = append(kinds, res.Kind)
+		if res.LastSyncTime.IsZero() {
+			t.Errorf("%s %q has no sync time", res.Kind, res.Name)
+		}
+	}
+	if expected := []string{"LimitRange", "Namespace", "ResourceQuota", "NetworkPolicy"}; !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("kinds of the managed resources %v, expected %v", kinds, expected)
+	}
+	rt.events()
+
+	// The limits are not configured anymore.
+	rt.r.CtrlConfig.Set(validConfig())
+	if _, s, err = rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if err := rt.r.Get(context.Background(), types.NamespacedName{Namespace: "pipelines", Name: LrName}, &corev1.LimitRange{}); !errors.IsNotFound(err) {
+		t.Errorf("the LimitRange has not been pruned: %v", err)
+	}
+	for _, res := range s.Status.ManagedResources {
+		if res.Kind == "LimitRange" {
+			t.Errorf("the pruned LimitRange is still in the inventory")
+		}
+	}
+	rt.expectCondition(s, "LimitRangesReady", metav1.ConditionTrue, "NotConfigured")
+	if events := rt.events(); !sameElements(events, []string{"Normal LimitRangeDeleted"}) {
+		t.Errorf("recorded events %v, expected a LimitRangeDeleted event", events)
+	}
+
+	// The namespace changes, the previous one is not deleted even with the Delete cleanup policy.
+	config := validConfig()
+	config.Namespace = "other"
+	config.CleanupPolicy = settingsv1alpha1.CleanupPolicyDelete
+	rt.r.CtrlConfig.Set(config)
+	if _, _, err = rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	var ns corev1.Namespace
+	if err := rt.r.Get(context.Background(), types.NamespacedName{Name: "pipelines"}, &ns); err != nil {
+		t.Fatalf("the previous namespace has been deleted: %v", err)
+	}
+	if len(ns.GetOwnerReferences()) > 0 || ns.GetLabels()[ManagedByLabel] != "" {
+		t.Errorf("the previous namespace has not been orphaned: %+v", ns.ObjectMeta)
+	}
+	if err := rt.r.Get(context.Background(), types.NamespacedName{Namespace: "pipelines", Name: QtName}, &corev1.ResourceQuota{}); !errors.IsNotFound(err) {
+		t.Errorf("the quota of the previous namespace has not been pruned: %v", err)
+	}
+}
@@ -0,0 +1,206 @@
+package controllers
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	cutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+// The logical cluster is not used as a label: the number of workspaces is unbounded
+// and their state is reported in the status of their Settings.
+// The metrics are labelled with the name of the APIExport as a controller can serve several of them.
+var (
+	// driftTotal counts the changes made to managed resources outside of the controller.
+	// The corrected label tells whether the desired state could be applied again.
+	driftTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "settings_controller_drift_total",
+			Help: "Number of drifts detected on the managed resources",
+		},
+		[]string{"export", "kind", "corrected"},
+	)
+
+	// applyResultsTotal counts the results of applying the managed resources.
+	applyResultsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "settings_controller_apply_results_total",
+			Help: "Number of managed resources applied per kind and result (created, updated, unchanged)",
+		},
+		[]string{"export", "kind", "result"},
+	)
+
+	// apiBindingsFilteredTotal counts the APIBinding events filtered out as the bindings are not for the APIExport.
+	apiBindingsFilteredTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "settings_controller_apibindings_filtered_total",
+			Help: "Number of APIBinding events filtered out as the bindings are not for the APIExport",
+		},
+		[]string{"export"},
+	)
+
+	// reconcileErrorsTotal counts the reconciliations, which failed, per reason.
+	reconcileErrorsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "settings_controller_reconcile_errors_total",
+			Help: "Number of reconcile errors per reason",
+		},
+		[]string{"export", "reason"},
+	)
+)
+
+func init() {
+	// Register custom metrics with the global prometheus registry
+	metrics.Registry.MustRegister(driftTotal, applyResultsTotal, apiBindingsFilteredTotal, reconcileErrorsTotal, workspaces)
+}
+
+// recordApplyResult counts the result of applying a managed resource.
+func (r *SettingsReconciler) recordApplyResult(kind string, result cutil.OperationResult) {
+	if result == cutil.OperationResultNone {
+		result = "unchanged"
+	}
+	applyResultsTotal.WithLabelValues(r.ExportName, kind, string(result)).Inc()
+}
+
+// recordReconcileError counts the error under the reason and returns it.
+func (r *SettingsReconciler) recordReconcileError(reason string, err error) error {
+	if err != nil {
+		reconcileErrorsTotal.WithLabelValues(r.ExportName, reason).Inc()
+	}
+	return err
+}
+
+// The workspace gauges are computed by the workspaceTracker when the metrics are collected.
+var (
+	// workspacesBoundDesc is the number of workspaces bound to the APIExport and managed by the controller.
+	workspacesBoundDesc = prometheus.NewDesc(
+		"settings_controller_workspaces_bound",
+		"Number of workspaces bound to the APIExport",
+		[]string{"export"}, nil,
+	)
+
+	// settingsConditionsDesc is the number of Settings per condition type and status.
+	settingsConditionsDesc = prometheus.NewDesc(
+		"settings_controller_settings_conditions",
+		"Number of Settings per condition type and status",
+		[]string{"export", "type", "status"}, nil,
+	)
+
+	// quotaPressureDesc is the number of workspaces whose quota usage exceeds the warning or the critical threshold.
+	quotaPressureDesc = prometheus.NewDesc(
+		"settings_controller_quota_pressure_workspaces",
+		"Number of workspaces whose quota usage exceeds the warning or the critical threshold",
+		[]string{"export", "level"}, nil,
+	)
+
+	// configHashesDesc is the number of workspaces per hash of the configuration last applied successfully.
+	// It allows following the rollout of a new configuration.
+	configHashesDesc = prometheus.NewDesc(
+		"settings_controller_config_hash_workspaces",
+		"Number of workspaces per hash of the configuration last applied successfully",
+		[]string{"export", "config_hash"}, nil,
+	)
+)
+
+// workspaces keeps track of the conditions and the configuration hash of the Settings of each bound workspace,
+// shared by the reconcilers of all shards and all APIExports, to compute the workspace gauges
+// and to gate the configuration rollout.
+var workspaces = &workspaceTracker{states: map[workspaceKey]workspaceState{}}
+
+// workspaceTracker implements prometheus.Collector. The gauges are computed from the tracked states
+// when they are collected so that they are always consistent with each other.
+type workspaceTracker struct {
+	lock   sync.Mutex
+	states map[workspaceKey]workspaceState
+}
+
+// workspaceKey identifies a workspace bound to an APIExport.
+type workspaceKey struct {
+	export    string
+	workspace string
+}
+
+// workspaceState is the state of the Settings of a workspace.
+type workspaceState struct {
+	conditions map[string]metav1.Condition
+	configHash string
+	canary     bool
+}
+
+// set records the conditions and the configuration hash of the workspace Settings and whether it is a canary.
+func (t *workspaceTracker) set(export, workspace string, status settingsv1alpha1.SettingsStatus, canary bool) {
+	conditions := map[string]metav1.Condition{}
+	for _, condition := range status.Conditions {
+		conditions[condition.Type] = condition
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.states[workspaceKey{export: export, workspace: workspace}] = workspaceState{
+		conditions: conditions,
+		configHash: status.ConfigHash,
+		canary:     canary,
+	}
+}
+
+// delete forgets the workspace when it gets unbound.
+func (t *workspaceTracker) delete(export, workspace string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.states, workspaceKey{export: export, workspace: workspace})
+}
+
+// Describe implements prometheus.Collector.
+func (t *workspaceTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- workspacesBoundDesc
+	ch <- settingsConditionsDesc
+	ch <- quotaPressureDesc
+	ch <- configHashesDesc
+}
+
+// Collect implements prometheus.Collector. It computes the gauges from the tracked states.
+func (t *workspaceTracker) Collect(ch chan<- prometheus.Metric) {
+	type conditionKey struct{ export, conditionType, status string }
+	type pressureKey struct{ export, level string }
+	type hashKey struct{ export, configHash string }
+	bound := map[string]int{}
+	conditions := map[conditionKey]int{}
+	pressure := map[pressureKey]int{}
+	hashes := map[hashKey]int{}
+
+	t.lock.Lock()
+	for key, state := range t.states {
+		bound[key.export]++
+		for conditionType, condition := range state.conditions {
+			conditions[conditionKey{key.export, conditionType, string(condition.Status)}]++
+		}
+		// Both levels are reported for each APIExport, even when no workspace is under pressure.
+		pressure[pressureKey{key.export, "warning"}] += 0
+		pressure[pressureKey{key.export, "critical"}] += 0
+		switch state.conditions["QuotaPressure"].Reason {
+		case "QuotaNearlyExhausted":
+			pressure[pressureKey{key.export, "warning"}]++
+		case "QuotaCritical":
+			pressure[pressureKey{key.export, "critical"}]++
+		}
+		hashes[hashKey{key.export, state.configHash}]++
+	}
+	t.lock.Unlock()
+
+	for export, count := range bound {
+		ch <- prometheus.MustNewConstMetric(workspacesBoundDesc, prometheus.GaugeValue, float64(count), export)
+	}
+	for key, count := range conditions {
+		ch <- prometheus.MustNewConstMetric(settingsConditionsDesc, prometheus.GaugeValue, float64(count), key.export, key.conditionType, key.status)
+	}
+	for key, count := range pressure {
+		ch <- prometheus.MustNewConstMetric(quotaPressureDesc, prometheus.GaugeValue, float64(count), key.export, key.level)
+	}
+	for key, count := range hashes {
+		ch <- prometheus.MustNewConstMetric(configHashesDesc, prometheus.GaugeValue, float64(count), key.export, key.configHash)
+	}
+}
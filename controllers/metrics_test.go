@@ -0,0 +1,103 @@
+package controllers
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+func TestWorkspaceTracker(t *testing.T) {
+	tracker := newTestWorkspaces(t)
+	// The collector is checked for consistency between the described and the collected metrics.
+	registry := prometheus.NewPedanticRegistry()
+	if err := registry.Register(tracker); err != nil {
+		t.Fatal(err)
+	}
+
+	tracker.set("staging", "root:org:a/settings", settingsv1alpha1.SettingsStatus{ConfigHash: "h1", Conditions: []metav1.Condition{
+		{Type: "QuotasReady", Status: metav1.ConditionTrue},
+		{Type: "NetworkPoliciesReady", Status: metav1.ConditionTrue},
+	}}, false)
+	tracker.set("staging", "root:org:b/settings", settingsv1alpha1.SettingsStatus{ConfigHash: "h2", Conditions: []metav1.Condition{
+		{Type: "QuotasReady", Status: metav1.ConditionFalse},
+		{Type: "NetworkPoliciesReady", Status: metav1.ConditionTrue},
+	}}, false)
+	tracker.set("staging", "root:org:c/settings", settingsv1alpha1.SettingsStatus{ConfigHash: "h2", Conditions: []metav1.Condition{
+		{Type: "QuotaPressure", Status: metav1.ConditionTrue, Reason: "QuotaCritical"},
+	}}, false)
+	// The conditions of a workspace are replaced.
+	tracker.set("staging", "root:org:b/settings", settingsv1alpha1.SettingsStatus{ConfigHash: "h2", Conditions: []metav1.Condition{
+		{Type: "QuotasReady", Status: metav1.ConditionTrue},
+		{Type: "NetworkPoliciesReady", Status: metav1.ConditionTrue},
+	}}, false)
+	// The same workspace bound to another APIExport is counted separately.
+	tracker.set("production", "root:org:a/settings", settingsv1alpha1.SettingsStatus{ConfigHash: "h3", Conditions: []metav1.Condition{
+		{Type: "QuotaPressure", Status: metav1.ConditionTrue, Reason: "QuotaNearlyExhausted"},
+	}}, false)
+
+	expected := `
+# HELP settings_controller_config_hash_workspaces Number of workspaces per hash of the configuration last applied successfully
+# TYPE settings_controller_config_hash_workspaces gauge
+settings_controller_config_hash_workspaces{config_hash="h1",export="staging"} 1
+settings_controller_config_hash_workspaces{config_hash="h2",export="staging"} 2
+settings_controller_config_hash_workspaces{config_hash="h3",export="production"} 1
+# HELP settings_controller_quota_pressure_workspaces Number of workspaces whose quota usage exceeds the warning or the critical threshold
+# TYPE settings_controller_quota_pressure_workspaces gauge
+settings_controller_quota_pressure_workspaces{export="production",level="critical"} 0
+settings_controller_quota_pressure_workspaces{export="production",level="warning"} 1
+settings_controller_quota_pressure_workspaces{export="staging",level="critical"} 1
+settings_controller_quota_pressure_workspaces{export="staging",level="warning"} 0
+# HELP settings_controller_settings_conditions Number of Settings per condition type and status
+# TYPE settings_controller_settings_conditions gauge
+settings_controller_settings_conditions{export="production",status="True",type="QuotaPressure"} 1
+settings_controller_settings_conditions{export="staging",status="True",type="NetworkPoliciesReady"} 2
+settings_controller_settings_conditions{export="staging",status="True",type="QuotaPressure"} 1
+settings_controller_settings_conditions{export="staging",status="True",type="QuotasReady"} 2
+# HELP settings_controller_workspaces_bound Number of workspaces bound to the APIExport
+# TYPE settings_controller_workspaces_bound gauge
+settings_controller_workspaces_bound{export="production"} 1
+settings_controller_workspaces_bound{export="staging"} 3
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Error(err)
+	}
+
+	tracker.delete("staging", "root:org:a/settings")
+	tracker.delete("staging", "root:org:c/settings")
+	// Deleting a workspace, which is not tracked, is a no-op.
+	tracker.delete("staging", "root:org:d/settings")
+	tracker.delete("production", "root:org:a/settings")
+
+	// The metrics of an APIExport without workspace are not reported anymore.
+	expected = `
+# HELP settings_controller_config_hash_workspaces Number of workspaces per hash of the configuration last applied successfully
+# TYPE settings_controller_config_hash_workspaces gauge
+settings_controller_config_hash_workspaces{config_hash="h2",export="staging"} 1
+# HELP settings_controller_quota_pressure_workspaces Number of workspaces whose quota usage exceeds the warning or the critical threshold
+# TYPE settings_controller_quota_pressure_workspaces gauge
+settings_controller_quota_pressure_workspaces{export="staging",level="critical"} 0
+settings_controller_quota_pressure_workspaces{export="staging",level="warning"} 0
+# HELP settings_controller_settings_conditions Number of Settings per condition type and status
+# TYPE settings_controller_settings_conditions gauge
+settings_controller_settings_conditions{export="staging",status="True",type="NetworkPoliciesReady"} 1
+settings_controller_settings_conditions{export="staging",status="True",type="QuotasReady"} 1
+# HELP settings_controller_workspaces_bound Number of workspaces bound to the APIExport
+# TYPE settings_controller_workspaces_bound gauge
+settings_controller_workspaces_bound{export="staging"} 1
+`
+	if err := testutil.GatherAndCompare(registry, strings.NewReader(expected)); err != nil {
+		t.Errorf("after the deletions: %v", err)
+	}
+}
+
+func TestWorkspaceTrackerEmpty(t *testing.T) {
+	tracker := newTestWorkspaces(t)
+	if count := testutil.CollectAndCount(tracker); count != 0 {
+		t.Errorf("%d metrics collected without workspace, expected none", count)
+	}
+}
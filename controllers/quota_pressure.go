@@ -0,0 +1,66 @@
+package controllers
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+// Default usage percentages of the quota hard limits, above which the quota pressure is reported.
+const (
+	DefaultQuotaWarningThreshold  = 80
+	DefaultQuotaCriticalThreshold = 95
+)
+
+// quotaThresholds returns the configured warning and critical thresholds or their default values.
+func quotaThresholds(config settingsv1alpha1.SettingsQuotaThresholds) (int64, int64) {
+	warning, critical := config.Warning, config.Critical
+	if warning == 0 {
+		warning = DefaultQuotaWarningThreshold
+	}
+	if critical == 0 {
+		critical = DefaultQuotaCriticalThreshold
+	}
+	return warning, critical
+}
+
+// setQuotaPressureCondition sets the condition according to the highest usage percentage of the quotas.
+// The resources whose usage exceeds the warning threshold are listed in the message.
+func setQuotaPressureCondition(condition *metav1.Condition, quotas []settingsv1alpha1.QuotaStatus, config settingsv1alpha1.SettingsQuotaThresholds) {
+	warning, critical := quotaThresholds(config)
+
+	var max int64
+	var pressured []string
+	for _, quota := range quotas {
+		for name, percentage := range quota.UsedPercentage {
+			if percentage > max {
+				max = percentage
+			}
+			if percentage >= warning {
+				used := quota.Used[name]
+				hard := quota.Hard[name]
+				pressured = append(pressured, fmt.Sprintf("%s/%s: %s of %s (%d%%)", quota.Name, name, used.String(), hard.String(), percentage))
+			}
+		}
+	}
+	sort.Strings(pressured)
+
+	switch {
+	case max >= critical:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "QuotaCritical"
+		condition.Message = fmt.Sprintf("Quota usage above %d%%: %s", critical, strings.Join(pressured, ", "))
+	case max >= warning:
+		condition.Status = metav1.ConditionTrue
+		condition.Reason = "QuotaNearlyExhausted"
+		condition.Message = fmt.Sprintf("Quota usage above %d%%: %s", warning, strings.Join(pressured, ", "))
+	default:
+		condition.Status = metav1.ConditionFalse
+		condition.Reason = "NoPressure"
+		condition.Message = fmt.Sprintf("Quota usage below %d%%", warning)
+	}
+}
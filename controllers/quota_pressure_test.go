@@ -0,0 +1,136 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+func TestSetQuotaPressureCondition(t *testing.T) {
+	usage := func(name, hard, used string, percentage int64) settingsv1alpha1.QuotaStatus {
+		return settingsv1alpha1.QuotaStatus{
+			Name:           name,
+			Hard:           resourceList("pods", hard),
+			Used:           resourceList("pods", used),
+			UsedPercentage: map[corev1.ResourceName]int64{"pods": percentage},
+		}
+	}
+	tests := []struct {
+		name       string
+		quotas     []settingsv1alpha1.QuotaStatus
+		thresholds settingsv1alpha1.SettingsQuotaThresholds
+		status     metav1.ConditionStatus
+		reason     string
+		message    string
+	}{
+		{name: "no quota", status: metav1.ConditionFalse, reason: "NoPressure", message: "Quota usage below 80%"},
+		{
+			name:    "below the warning threshold",
+			quotas:  []settingsv1alpha1.QuotaStatus{usage("compute", "100", "79", 79)},
+			status:  metav1.ConditionFalse,
+			reason:  "NoPressure",
+			message: "Quota usage below 80%",
+		},
+		{
+			name:    "at the warning threshold",
+			quotas:  []settingsv1alpha1.QuotaStatus{usage("compute", "100", "80", 80)},
+			status:  metav1.ConditionTrue,
+			reason:  "QuotaNearlyExhausted",
+			message: "Quota usage above 80%: compute/pods: 80 of 100 (80%)",
+		},
+		{
+			name:    "at the critical threshold",
+			quotas:  []settingsv1alpha1.QuotaStatus{usage("compute", "100", "95", 95)},
+			status:  metav1.ConditionTrue,
+			reason:  "QuotaCritical",
+			message: "Quota usage above 95%: compute/pods: 95 of 100 (95%)",
+		},
+		{
+			name:    "highest usage of several quotas",
+			quotas:  []settingsv1alpha1.QuotaStatus{usage("storage", "10", "10", 100), usage("compute", "100", "85", 85), usage("other", "10", "1", 10)},
+			status:  metav1.ConditionTrue,
+			reason:  "QuotaCritical",
+			message: "Quota usage above 95%: compute/pods: 85 of 100 (85%), storage/pods: 10 of 10 (100%)",
+		},
+		{
+			name:       "configured thresholds",
+			quotas:     []settingsv1alpha1.QuotaStatus{usage("compute", "100", "60", 60)},
+			thresholds: settingsv1alpha1.SettingsQuotaThresholds{Warning: 50, Critical: 70},
+			status:     metav1.ConditionTrue,
+			reason:     "QuotaNearlyExhausted",
+			message:    "Quota usage above 50%: compute/pods: 60 of 100 (60%)",
+		},
+		{
+			name:       "configured critical threshold",
+			quotas:     []settingsv1alpha1.QuotaStatus{usage("compute", "100", "90", 90)},
+			thresholds: settingsv1alpha1.SettingsQuotaThresholds{Critical: 90},
+			status:     metav1.ConditionTrue,
+			reason:     "QuotaCritical",
+			message:    "Quota usage above 90%: compute/pods: 90 of 100 (90%)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var condition metav1.Condition
+			setQuotaPressureCondition(&condition, tt.quotas, tt.thresholds)
+			if condition.Status != tt.status || condition.Reason != tt.reason || condition.Message != tt.message {
+				t.Errorf("condition is %s/%s %q, expected %s/%s %q", condition.Status, condition.Reason, condition.Message, tt.status, tt.reason, tt.message)
+			}
+		})
+	}
+}
+
+func TestReconcileQuotaPressureEvents(t *testing.T) {
+	config := managedConfig("100")
+	rt := newReconcileTest(t, config, requiredClaims())
+	if _, _, err := rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	rt.events()
+
+	// setUsage emulates the quota controller updating the usage of the pipeline runs.
+	setUsage := func(used string) {
+		t.Helper()
+		var quota corev1.ResourceQuota
+		rt.get(config.Namespace, QtName, &quota)
+		quota.Status.Hard = quota.Spec.Hard
+		quota.Status.Used = resourceList("count/pipelineruns.tekton.dev", used)
+		if err := rt.r.Status().Update(context.Background(), &quota); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	steps := []struct {
+		used   string
+		reason string
+		events []string
+	}{
+		{used: "50", reason: "NoPressure"},
+		{used: "85", reason: "QuotaNearlyExhausted", events: []string{"Warning QuotaNearlyExhausted"}},
+		// The warning is only recorded when the level of pressure changes.
+		{used: "90", reason: "QuotaNearlyExhausted"},
+		{used: "96", reason: "QuotaCritical", events: []string{"Warning QuotaCritical"}},
+		{used: "97", reason: "QuotaCritical"},
+		{used: "10", reason: "NoPressure"},
+		{used: "85", reason: "QuotaNearlyExhausted", events: []string{"Warning QuotaNearlyExhausted"}},
+	}
+	for _, step := range steps {
+		setUsage(step.used)
+		_, s, err := rt.reconcile()
+		if err != nil {
+			t.Fatalf("reconcile with %s pipeline runs failed: %v", step.used, err)
+		}
+		status := metav1.ConditionTrue
+		if step.reason == "NoPressure" {
+			status = metav1.ConditionFalse
+		}
+		rt.expectCondition(s, "QuotaPressure", status, step.reason)
+		if events := rt.events(); !sameElements(events, step.events) {
+			t.Errorf("events recorded with %s pipeline runs: %v, expected %v", step.used, events, step.events)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package controllers
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// managedConfig returns a configuration managing all the kinds of resources.
+func managedConfig(pipelineRuns string) settingsv1alpha1.SettingsConfig {
+	config := validConfig()
+	config.QuotaConfig.Spec.Hard = resourceList("count/pipelineruns.tekton.dev", pipelineRuns)
+	config.LimitRangeConfig.Spec.Limits = []corev1.LimitRangeItem{{
+		Type:           corev1.LimitTypeContainer,
+		DefaultRequest: resourceList("cpu", "100m"),
+	}}
+	return config
+}
+
+// reconcileTest holds a reconciler running against a fake workspace with an APIBinding to the test export.
+type reconcileTest struct {
+	t   *testing.T
+	r   *SettingsReconciler
+	ab  *apisv1alpha1.APIBinding
+	req ctrl.Request
+}
+
+func newReconcileTest(t *testing.T, config settingsv1alpha1.SettingsConfig, claims []apisv1alpha1.GroupResource, objs ...client.Object) *reconcileTest {
+	ab := newTestAPIBinding()
+	for _, claim := range claims {
+		ab.Spec.AcceptedPermissionClaims = append(ab.Spec.AcceptedPermissionClaims, apisv1alpha1.PermissionClaim{GroupResource: claim})
+	}
+	r := newTestReconciler(t, NewConfigStore(config), append(objs, ab)...)
+	r.ExportName = testExportName
+	r.ExportIdentityHash = testExportIdentity
+	return &reconcileTest{
+		t:   t,
+		r:   r,
+		ab:  ab,
+		req: ctrl.Request{NamespacedName: types.NamespacedName{Name: ab.Name}, ClusterName: "root:org:ws"},
+	}
+}
+
+// reconcile runs the reconciliation till no immediate requeue is requested and returns the Settings.
+func (rt *reconcileTest) reconcile() (ctrl.Result, *settingsv1alpha1.Settings, error) {
+	var result ctrl.Result
+	var err error
+	for i := 0; i < 10; i++ {
+		if result, err = rt.r.Reconcile(context.Background(), rt.req); err != nil || !result.Requeue {
+			break
+		}
+	}
+	var s settingsv1alpha1.Settings
+	rt.get("", SettingName, &s)
+	return result, &s, err
+}
+
+func (rt *reconcileTest) get(namespace, name string, obj client.Object) {
+	rt.t.Helper()
+	if err := rt.r.Get(context.Background(), types.NamespacedName{Namespace: namespace, Name: name}, obj); err != nil {
+		rt.t.Fatalf("unable to get %q: %v", name, err)
+	}
+}
+
+// events returns the type and the reason of the events recorded since the last call.
+func (rt *reconcileTest) events() []string {
+	var events []string
+	for _, event := range takeEvents(rt.t, rt.r.Client) {
+		fields := strings.Fields(event)
+		events = append(events, fields[0]+" "+fields[1])
+	}
+	return events
+}
+
+// expectCondition checks the status and the reason of a condition of the Settings.
+func (rt *reconcileTest) expectCondition(s *settingsv1alpha1.Settings, conditionType string, status metav1.ConditionStatus, reason string) {
+	rt.t.Helper()
+	condition := meta.FindStatusCondition(s.Status.Conditions, conditionType)
+	if condition == nil {
+		rt.t.Errorf("condition %s not found", conditionType)
+		return
+	}
+	if condition.Status != status || condition.Reason != reason {
+		rt.t.Errorf("condition %s is %s/%s, expected %s/%s: %s", conditionType, condition.Status, condition.Reason, status, reason, condition.Message)
+	}
+}
+
+func TestReconcileManagedResources(t *testing.T) {
+	config := managedConfig("100")
+	rt := newReconcileTest(t, config, requiredClaims())
+
+	_, s, err := rt.reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	for _, conditionType := range []string{"NetworkPoliciesReady", "QuotasReady", "LimitRangesReady"} {
+		rt.expectCondition(s, conditionType, metav1.ConditionTrue, conditionType[:len(conditionType)-len("Ready")]+"Created")
+	}
+	rt.expectCondition(s, "NamespaceReady", metav1.ConditionTrue, "NamespaceOwned")
+	rt.expectCondition(s, "DriftDetected", metav1.ConditionFalse, "NoDrift")
+	rt.expectCondition(s, "PermissionClaimsAccepted", metav1.ConditionTrue, "ClaimsAccepted")
+	cHash, _ := configHash(config)
+	if s.Status.ObservedGeneration != s.Generation || s.Status.ConfigHash != cHash || s.Status.DesiredStateHash == "" {
+		t.Errorf("unexpected generation and hashes in the status: %+v", s.Status)
+	}
+	appliedStatus := s.Status
+
+	var ns corev1.Namespace
+	rt.get("", config.Namespace, &ns)
+	if !metav1.IsControlledBy(&ns, rt.ab) || ns.Labels[ManagedByLabel] != FieldManager {
+		t.Errorf("the namespace is not managed by the controller: %+v", ns.ObjectMeta)
+	}
+	rt.get(config.Namespace, NpName, &netv1.NetworkPolicy{})
+	rt.get(config.Namespace, LrName, &corev1.LimitRange{})
+	if len(s.Status.Quotas) != 1 || s.Status.Quotas[0].Name != QtName {
+		t.Errorf("unexpected quotas in the status: %+v", s.Status.Quotas)
+	}
+	expected := []string{"Normal NamespaceCreated", "Normal ResourceQuotaCreated", "Normal NetworkPolicyCreated", "Normal LimitRangeCreated"}
+	if events := rt.events(); !sameElements(events, expected) {
+		t.Errorf("recorded events %v, expected %v", events, expected)
+	}
+
+	// A tenant raises the quota: the field is not owned by the controller anymore and the conflict is reported.
+	var quota corev1.ResourceQuota
+	rt.get(config.Namespace, QtName, &quota)
+	quota.Spec.Hard = resourceList("count/pipelineruns.tekton.dev", "1000")
+	if err := rt.r.Update(context.Background(), &quota, client.FieldOwner("kubectl-edit")); err != nil {
+		t.Fatal(err)
+	}
+	// The configuration changes meanwhile.
+	rt.r.CtrlConfig.Set(managedConfig("200"))
+	if _, s, err = rt.reconcile(); !isConflict(err) {
+		t.Errorf("reconcile error = %v, expected a conflict", err)
+	}
+	rt.expectCondition(s, "QuotasReady", metav1.ConditionFalse, "ApplyConflict")
+	// The hashes are only updated once the new desired state has been applied.
+	if s.Status.ConfigHash != appliedStatus.ConfigHash || s.Status.DesiredStateHash != appliedStatus.DesiredStateHash {
+		t.Errorf("the hashes have been updated on failure: %+v", s.Status)
+	}
+	rt.get(config.Namespace, QtName, &quota)
+	if q := quota.Spec.Hard["count/pipelineruns.tekton.dev"]; q.Value() != 1000 {
+		t.Errorf("the field owned by the tenant has been overridden: %s", q.String())
+	}
+	expected = []string{"Warning ResourceQuotasFailed"}
+	if events := rt.events(); !sameElements(events, expected) {
+		t.Errorf("recorded events %v, expected %v", events, expected)
+	}
+}
+
+func TestReconcileDriftNotCorrected(t *testing.T) {
+	config := managedConfig("100")
+	rt := newReconcileTest(t, config, requiredClaims())
+	if _, _, err := rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	rt.events()
+
+	// A tenant raises the quota without any configuration change: the drift cannot be reverted.
+	var quota corev1.ResourceQuota
+	rt.get(config.Namespace, QtName, &quota)
+	quota.Spec.Hard = resourceList("count/pipelineruns.tekton.dev", "1000")
+	if err := rt.r.Update(context.Background(), &quota, client.FieldOwner("kubectl-edit")); err != nil {
+		t.Fatal(err)
+	}
+	_, s, err := rt.reconcile()
+	if !isConflict(err) {
+		t.Errorf("reconcile error = %v, expected a conflict", err)
+	}
+	rt.expectCondition(s, "DriftDetected", metav1.ConditionTrue, "DriftNotCorrected")
+	expected := []string{"Warning ResourceQuotasFailed", "Warning DriftNotCorrected"}
+	if events := rt.events(); !sameElements(events, expected) {
+		t.Errorf("recorded events %v, expected %v", events, expected)
+	}
+
+	// The warnings are not repeated while the failure lasts.
+	if _, s, err = rt.reconcile(); !isConflict(err) {
+		t.Errorf("reconcile error = %v, expected a conflict", err)
+	}
+	rt.expectCondition(s, "DriftDetected", metav1.ConditionTrue, "DriftNotCorrected")
+	if events := rt.events(); len(events) > 0 {
+		t.Errorf("recorded events %v, expected none", events)
+	}
+}
+
+func TestReconcileNamespaceConflict(t *testing.T) {
+	config := managedConfig("100")
+	rt := newReconcileTest(t, config, requiredClaims())
+	if _, _, err := rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	rt.events()
+
+	// A tenant changes the owner reference set by the controller.
+	var ns corev1.Namespace
+	rt.get("", config.Namespace, &ns)
+	blockOwnerDeletion := false
+	ns.OwnerReferences[0].BlockOwnerDeletion = &blockOwnerDeletion
+	if err := rt.r.Update(context.Background(), &ns, client.FieldOwner("kubectl-edit")); err != nil {
+		t.Fatal(err)
+	}
+	_, s, err := rt.reconcile()
+	if !isConflict(err) {
+		t.Errorf("reconcile error = %v, expected a conflict", err)
+	}
+	rt.expectCondition(s, "NamespaceReady", metav1.ConditionFalse, "ApplyConflict")
+	for _, conditionType := range []string{"NetworkPoliciesReady", "QuotasReady", "LimitRangesReady"} {
+		rt.expectCondition(s, conditionType, metav1.ConditionFalse, "NamespaceNotReady")
+	}
+	expected := []string{"Warning NamespaceFailed"}
+	if events := rt.events(); !sameElements(events, expected) {
+		t.Errorf("recorded events %v, expected %v", events, expected)
+	}
+
+	// The warning is not repeated while the conflict lasts.
+	if _, _, err = rt.reconcile(); !isConflict(err) {
+		t.Errorf("reconcile error = %v, expected a conflict", err)
+	}
+	if events := rt.events(); len(events) > 0 {
+		t.Errorf("recorded events %v, expected none", events)
+	}
+}
+
+func TestReconcileClampedQuotaOverrides(t *testing.T) {
+	config := managedConfig("100")
+	config.MaxQuotaOverrides = resourceList("count/pipelineruns.tekton.dev", "150")
+	config.QuotaOverrides = []settingsv1alpha1.SettingsQuotaOverride{
+		{Workspace: "root:org:ws", Hard: resourceList("count/pipelineruns.tekton.dev", "200")},
+	}
+	rt := newReconcileTest(t, config, requiredClaims())
+	if _, _, err := rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	var quota corev1.ResourceQuota
+	rt.get(config.Namespace, QtName, &quota)
+	if q := quota.Spec.Hard["count/pipelineruns.tekton.dev"]; q.String() != "150" {
+		t.Errorf("the override has not been lowered to the maximum: %s", q.String())
+	}
+	expected := []string{"Warning QuotaOverridesClamped", "Normal NamespaceCreated", "Normal ResourceQuotaCreated", "Normal NetworkPolicyCreated", "Normal LimitRangeCreated"}
+	if events := rt.events(); !sameElements(events, expected) {
+		t.Errorf("recorded events %v, expected %v", events, expected)
+	}
+
+	// The warning is not repeated as long as the desired state does not change.
+	if _, _, err := rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if events := rt.events(); len(events) != 0 {
+		t.Errorf("unexpected events on the second reconciliation: %v", events)
+	}
+}
+
+func TestReconcileExistingNamespace(t *testing.T) {
+	controller := true
+	other := metav1.OwnerReference{APIVersion: "v1", Kind: "ConfigMap", Name: "owner", UID: "other", Controller: &controller}
+	tests := []struct {
+		name   string
+		policy settingsv1alpha1.NamespacePolicy
+		labels map[string]string
+		owners []metav1.OwnerReference
+		owned  bool
+		reason string
+		events []string
+	}{
+		{name: "refused by default", reason: "NamespaceNotOwned", events: []string{"Warning NamespaceNotOwned"}},
+		{name: "refused", policy: settingsv1alpha1.NamespacePolicyRefuse, reason: "NamespaceNotOwned", events: []string{"Warning NamespaceNotOwned"}},
+		{
+			name:   "adopted",
+			policy: settingsv1alpha1.NamespacePolicyAdopt,
+			owned:  true,
+			reason: "NamespaceOwned",
+			events: []string{"Normal NamespaceUpdated", "Normal ResourceQuotaCreated", "Normal NetworkPolicyCreated", "Normal LimitRangeCreated"},
+		},
+		{
+			name:   "previously orphaned",
+			policy: settingsv1alpha1.NamespacePolicyRefuse,
+			labels: map[string]string{ManagedByLabel: FieldManager},
+			owned:  true,
+			reason: "NamespaceOwned",
+			events: []string{"Normal NamespaceUpdated", "Normal ResourceQuotaCreated", "Normal NetworkPolicyCreated", "Normal LimitRangeCreated"},
+		},
+		{
+			name:   "controlled by another owner",
+			policy: settingsv1alpha1.NamespacePolicyAdopt,
+			owners: []metav1.OwnerReference{other},
+			reason: "NamespaceControlledByOther",
+			events: []string{"Warning NamespaceControlledByOther"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := managedConfig("100")
+			config.NamespacePolicy = tt.policy
+			existing := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: config.Namespace, Labels: tt.labels, OwnerReferences: tt.owners}}
+			rt := newReconcileTest(t, config, requiredClaims(), existing)
+
+			result, s, err := rt.reconcile()
+			if err != nil {
+				t.Fatalf("reconcile failed: %v", err)
+			}
+			status := metav1.ConditionFalse
+			if tt.owned {
+				status = metav1.ConditionTrue
+			}
+			rt.expectCondition(s, "NamespaceReady", status, tt.reason)
+			if events := rt.events(); !sameElements(events, tt.events) {
+				t.Errorf("recorded events %v, expected %v", events, tt.events)
+			}
+			var ns corev1.Namespace
+			rt.get("", config.Namespace, &ns)
+			if owned := metav1.IsControlledBy(&ns, rt.ab); owned != tt.owned {
+				t.Errorf("the namespace is controlled by the APIBinding: %t, expected %t", owned, tt.owned)
+			}
+			err = rt.r.Get(context.Background(), types.NamespacedName{Namespace: config.Namespace, Name: QtName}, &corev1.ResourceQuota{})
+			if tt.owned {
+				if err != nil {
+					t.Errorf("the quota has not been created: %v", err)
+				}
+				return
+			}
+			if !errors.IsNotFound(err) {
+				t.Errorf("a quota has been created in a refused namespace: %v", err)
+			}
+			rt.expectCondition(s, "QuotasReady", metav1.ConditionFalse, "NamespaceNotReady")
+			if result.RequeueAfter != NamespaceRequeuePeriod {
+				t.Errorf("the workspace is requeued after %v, expected %v", result.RequeueAfter, NamespaceRequeuePeriod)
+			}
+
+			// The refusal is reported once.
+			if _, _, err := rt.reconcile(); err != nil {
+				t.Fatalf("reconcile failed: %v", err)
+			}
+			if events := rt.events(); len(events) != 0 {
+				t.Errorf("unexpected events on the second reconciliation: %v", events)
+			}
+		})
+	}
+}
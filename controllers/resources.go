@@ -0,0 +1,314 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	cutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// networkPolicies returns the NetworkPolicies to create according to the configuration.
+// The single policy specification is used, under the NpName name, when no named policies are configured.
+func networkPolicies(config settingsv1alpha1.SettingsNetPolConfig) []settingsv1alpha1.NamedNetworkPolicy {
+	if len(config.Policies) > 0 {
+		return config.Policies
+	}
+	return []settingsv1alpha1.NamedNetworkPolicy{{Name: NpName, Spec: config.Spec}}
+}
+
+// reconcileNetworkPolicies applies the configured NetworkPolicies in the namespace and records them in the inventory.
+// There is no enforcement, more a feature (hermetic build) than a constraint.
+func (r *SettingsReconciler) reconcileNetworkPolicies(ctx context.Context, ab *apisv1alpha1.APIBinding, namespace string, config settingsv1alpha1.SettingsNetPolConfig, drifts *driftReport, events *settingsEvents, inv *inventory) error {
+	logger := ctrl.LoggerFrom(ctx)
+
+	var errs []error
+	for _, policy := range networkPolicies(config) {
+		desiredHash, err := hash(policy.Spec)
+		inv.add(netv1.GroupName, "NetworkPolicy", namespace, policy.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var live netv1.NetworkPolicy
+		if err := r.getLive(ctx, namespace, policy.Name, &live); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := drifts.check("NetworkPolicy", &live, &live.Spec, &policy.Spec, desiredHash); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		wsNP := netv1.NetworkPolicy{
+			TypeMeta: metav1.TypeMeta{APIVersion: netv1.SchemeGroupVersion.String(), Kind: "NetworkPolicy"},
+			Spec:     *policy.Spec.DeepCopy(),
+		}
+		wsNP.SetNamespace(namespace)
+		wsNP.SetName(policy.Name)
+		setDesiredHash(&wsNP, desiredHash)
+		// Set the APIBinding instance as the owner and controller
+		ctrl.SetControllerReference(ab, &wsNP, r.Scheme)
+		operationResult, err := r.apply(ctx, ab, &wsNP, &live)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to apply the NetworkPolicy %q: %w", policy.Name, err))
+			continue
+		}
+		logger.V(2).Info(string(operationResult), "resource", wsNP)
+		events.applied("NetworkPolicy", policy.Name, operationResult)
+		drifts.corrected("NetworkPolicy", policy.Name)
+		inv.synced(netv1.GroupName, "NetworkPolicy", namespace, policy.Name, desiredHash, operationResult)
+	}
+	return kerrors.NewAggregate(errs)
+}
+
+// resourceQuotas returns the ResourceQuotas to create according to the configuration, with the overrides
+// merged over their hard limits. A resource of the overrides replaces the limit in every quota defining it
+// or is added to the first quota if none defines it.
+// The single quota specification is used, under the QtName name, when no named quotas are configured.
+func resourceQuotas(config settingsv1alpha1.SettingsQuotaConfig, overrides corev1.ResourceList) []settingsv1alpha1.NamedResourceQuota {
+	var quotas []settingsv1alpha1.NamedResourceQuota
+	if len(config.Quotas) > 0 {
+		for _, quota := range config.Quotas {
+			quotas = append(quotas, *quota.DeepCopy())
+		}
+	} else {
+		quotas = []settingsv1alpha1.NamedResourceQuota{{Name: QtName, Spec: *config.Spec.DeepCopy()}}
+	}
+
+	for name, quantity := range overrides {
+		defined := false
+		for i := range quotas {
+			if _, ok := quotas[i].Spec.Hard[name]; ok {
+				quotas[i].Spec.Hard[name] = quantity.DeepCopy()
+				defined = true
+			}
+		}
+		if !defined {
+			if quotas[0].Spec.Hard == nil {
+				quotas[0].Spec.Hard = corev1.ResourceList{}
+			}
+			quotas[0].Spec.Hard[name] = quantity.DeepCopy()
+		}
+	}
+	return quotas
+}
+
+// quotaOverrides returns the quota overrides configured for the workspace, within the maxima set by the
+// administrator, and the description of the overrides, which have been dropped or lowered to stay within them.
+// The configuration is validated when it is loaded, this protects the workspaces if the validation is bypassed.
+func quotaOverrides(config *settingsv1alpha1.SettingsConfig, workspace string) (corev1.ResourceList, []string) {
+	var hard corev1.ResourceList
+	for _, override := range config.QuotaOverrides {
+		if override.Workspace == workspace {
+			hard = override.Hard
+			break
+		}
+	}
+	if len(hard) == 0 || len(config.MaxQuotaOverrides) == 0 {
+		return hard, nil
+	}
+	overrides := corev1.ResourceList{}
+	var clamped []string
+	for name, quantity := range hard {
+		max, ok := config.MaxQuotaOverrides[name]
+		switch {
+		case !ok:
+			clamped = append(clamped, fmt.Sprintf("%s cannot be overridden", name))
+		case quantity.Cmp(max) > 0:
+			clamped = append(clamped, fmt.Sprintf("%s lowered from %s to %s", name, quantity.String(), max.String()))
+			overrides[name] = max.DeepCopy()
+		default:
+			overrides[name] = quantity.DeepCopy()
+		}
+	}
+	sort.Strings(clamped)
+	return overrides, clamped
+}
+
+// reconcileResourceQuotas applies the ResourceQuotas in the namespace and records them in the inventory.
+// The status of the applied quotas is returned.
+// The annotation makes the quotas cluster scoped.
+// Reverse claim should enforce that the quotas cannot be changed by a workspace admin
+// as long the workspace is bound to the apiexport of the controller
+func (r *SettingsReconciler) reconcileResourceQuotas(ctx context.Context, ab *apisv1alpha1.APIBinding, namespace string, quotas []settingsv1alpha1.NamedResourceQuota, drifts *driftReport, events *settingsEvents, inv *inventory) ([]settingsv1alpha1.QuotaStatus, error) {
+	logger := ctrl.LoggerFrom(ctx)
+
+	var statuses []settingsv1alpha1.QuotaStatus
+	var errs []error
+	for _, quota := range quotas {
+		desiredHash, err := hash(quota.Spec)
+		inv.add(corev1.GroupName, "ResourceQuota", namespace, quota.Name)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		var live corev1.ResourceQuota
+		if err := r.getLive(ctx, namespace, quota.Name, &live); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if err := drifts.check("ResourceQuota", &live, &live.Spec, &quota.Spec, desiredHash); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		wsQt := corev1.ResourceQuota{
+			TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "ResourceQuota"},
+			Spec:     *quota.Spec.DeepCopy(),
+		}
+		wsQt.SetNamespace(namespace)
+		wsQt.SetName(quota.Name)
+		wsQt.SetAnnotations(map[string]string{"experimental.quota.kcp.dev/cluster-scoped": "true"})
+		setDesiredHash(&wsQt, desiredHash)
+		// Set the APIBinding instance as the owner and controller
+		ctrl.SetControllerReference(ab, &wsQt, r.Scheme)
+		operationResult, err := r.apply(ctx, ab, &wsQt, &live)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("unable to apply the ResourceQuota %q: %w", quota.Name, err))
+			continue
+		}
+		logger.V(2).Info(string(operationResult), "resource", wsQt)
+		events.applied("ResourceQuota", quota.Name, operationResult)
+		drifts.corrected("ResourceQuota", quota.Name)
+		inv.synced(corev1.GroupName, "ResourceQuota", namespace, quota.Name, desiredHash, operationResult)
+		// The applied object carries the status last computed by the quota controller.
+		statuses = append(statuses, quotaStatus(&wsQt))
+	}
+	return statuses, kerrors.NewAggregate(errs)
+}
+
+// quotaStatus returns the hard limits and the usage of the ResourceQuota
+// with the usage of each resource as a percentage of its hard limit.
+func quotaStatus(quota *corev1.ResourceQuota) settingsv1alpha1.QuotaStatus {
+	status := settingsv1alpha1.QuotaStatus{
+		Name: quota.Name,
+		Hard: quota.Status.Hard.DeepCopy(),
+		Used: quota.Status.Used.DeepCopy(),
+	}
+	for name, hard := range quota.Status.Hard {
+		used, ok := quota.Status.Used[name]
+		if !ok || hard.IsZero() {
+			continue
+		}
+		if status.UsedPercentage == nil {
+			status.UsedPercentage = map[corev1.ResourceName]int64{}
+		}
+		// The milli values would overflow for large quantities, an approximation is precise enough for a percentage.
+		status.UsedPercentage[name] = int64(used.AsApproximateFloat64() * 100 / hard.AsApproximateFloat64())
+	}
+	return status
+}
+
+// reconcileLimitRange applies the LimitRange in the namespace, so that default requests
+// and limits are set on the containers, and records it in the inventory.
+// It is left out of the inventory, hence pruned, when no limit is configured.
+func (r *SettingsReconciler) reconcileLimitRange(ctx context.Context, ab *apisv1alpha1.APIBinding, namespace string, config settingsv1alpha1.SettingsLimitRangeConfig, drifts *driftReport, events *settingsEvents, inv *inventory) error {
+	logger := ctrl.LoggerFrom(ctx)
+
+	if len(config.Spec.Limits) > 0 {
+		desiredHash, err := hash(config.Spec)
+		inv.add(corev1.GroupName, "LimitRange", namespace, LrName)
+		if err != nil {
+			return err
+		}
+		var live corev1.LimitRange
+		if err := r.getLive(ctx, namespace, LrName, &live); err != nil {
+			return err
+		}
+		if err := drifts.check("LimitRange", &live, &live.Spec, &config.Spec, desiredHash); err != nil {
+			return err
+		}
+
+		wsLR := corev1.LimitRange{
+			TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "LimitRange"},
+			Spec:     *config.Spec.DeepCopy(),
+		}
+		wsLR.SetNamespace(namespace)
+		wsLR.SetName(LrName)
+		setDesiredHash(&wsLR, desiredHash)
+		// Set the APIBinding instance as the owner and controller
+		ctrl.SetControllerReference(ab, &wsLR, r.Scheme)
+		operationResult, err := r.apply(ctx, ab, &wsLR, &live)
+		if err != nil {
+			return fmt.Errorf("unable to apply the LimitRange %q: %w", LrName, err)
+		}
+		logger.V(2).Info(string(operationResult), "resource", wsLR)
+		events.applied("LimitRange", LrName, operationResult)
+		drifts.corrected("LimitRange", LrName)
+		inv.synced(corev1.GroupName, "LimitRange", namespace, LrName, desiredHash, operationResult)
+	}
+	return nil
+}
+
+// getLive reads the current state of a managed object. The object is left empty if it does not exist.
+func (r *SettingsReconciler) getLive(ctx context.Context, namespace, name string, obj client.Object) error {
+	if err := r.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, obj); err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("unable to get %q: %w", name, err)
+	}
+	return nil
+}
+
+// apply creates or updates the object with server-side apply, using the controller field manager.
+// Only the fields set by the controller are enforced. Ownership is not forced so that
+// conflicts with other writers are surfaced rather than clobbered.
+// The live object, read beforehand, is used to determine the result of the operation.
+// Objects created by previous versions of the controller with CreateOrPatch are owned by an update
+// field manager. Ownership is forced once for them so that the fields are migrated to the apply manager.
+// It is only forced on objects controlled by the APIBinding: an object created by someone else is left alone
+// and the conflict is returned.
+func (r *SettingsReconciler) apply(ctx context.Context, ab *apisv1alpha1.APIBinding, obj client.Object, live client.Object) (cutil.OperationResult, error) {
+	// The type meta may be cleared when the response is decoded.
+	kind := obj.GetObjectKind().GroupVersionKind().Kind
+	opts := []client.PatchOption{client.FieldOwner(FieldManager)}
+	if live.GetResourceVersion() != "" && !appliedByController(live) && metav1.IsControlledBy(live, ab) {
+		ctrl.LoggerFrom(ctx).V(1).Info("Taking over the fields of an object not yet applied by the controller", "kind", kind, "name", obj.GetName())
+		opts = append(opts, client.ForceOwnership)
+	}
+	if err := r.Patch(ctx, obj, client.Apply, opts...); err != nil {
+		return cutil.OperationResultNone, err
+	}
+	result := cutil.OperationResultNone
+	switch {
+	case live.GetResourceVersion() == "":
+		result = cutil.OperationResultCreated
+	case live.GetResourceVersion() != obj.GetResourceVersion():
+		result = cutil.OperationResultUpdated
+	}
+	r.recordApplyResult(kind, result)
+	return result, nil
+}
+
+// appliedByController returns true if the controller field manager has already applied the object.
+func appliedByController(obj client.Object) bool {
+	for _, entry := range obj.GetManagedFields() {
+		if entry.Manager == FieldManager && entry.Operation == metav1.ManagedFieldsOperationApply {
+			return true
+		}
+	}
+	return false
+}
+
+// isConflict returns true if the error, or one of the aggregated errors, is a server-side apply conflict.
+func isConflict(err error) bool {
+	if agg, ok := err.(kerrors.Aggregate); ok {
+		for _, e := range agg.Errors() {
+			if isConflict(e) {
+				return true
+			}
+		}
+		return false
+	}
+	return errors.IsConflict(err)
+}
@@ -0,0 +1,349 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	cutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+func TestNetworkPolicies(t *testing.T) {
+	ingress := netv1.NetworkPolicySpec{PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeIngress}}
+	egress := netv1.NetworkPolicySpec{PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeEgress}}
+	tests := []struct {
+		name     string
+		config   settingsv1alpha1.SettingsNetPolConfig
+		policies []settingsv1alpha1.NamedNetworkPolicy
+	}{
+		{
+			name:     "single policy",
+			config:   settingsv1alpha1.SettingsNetPolConfig{Spec: ingress},
+			policies: []settingsv1alpha1.NamedNetworkPolicy{{Name: NpName, Spec: ingress}},
+		},
+		{
+			name: "named policies taking precedence",
+			config: settingsv1alpha1.SettingsNetPolConfig{Spec: ingress, Policies: []settingsv1alpha1.NamedNetworkPolicy{
+				{Name: "default-deny", Spec: ingress},
+				{Name: "allow-dns", Spec: egress},
+			}},
+			policies: []settingsv1alpha1.NamedNetworkPolicy{{Name: "default-deny", Spec: ingress}, {Name: "allow-dns", Spec: egress}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if policies := networkPolicies(tt.config); !equality.Semantic.DeepEqual(policies, tt.policies) {
+				t.Errorf("networkPolicies() = %+v, expected %+v", policies, tt.policies)
+			}
+		})
+	}
+}
+
+func TestResourceQuotas(t *testing.T) {
+	named := settingsv1alpha1.SettingsQuotaConfig{Quotas: []settingsv1alpha1.NamedResourceQuota{
+		{Name: "compute", Spec: corev1.ResourceQuotaSpec{Hard: resourceList("cpu", "2", "memory", "4Gi")}},
+		{Name: "objects", Spec: corev1.ResourceQuotaSpec{Hard: resourceList("count/pipelineruns.tekton.dev", "100", "cpu", "4")}},
+	}}
+	tests := []struct {
+		name      string
+		config    settingsv1alpha1.SettingsQuotaConfig
+		overrides corev1.ResourceList
+		quotas    []settingsv1alpha1.NamedResourceQuota
+	}{
+		{
+			name:   "single quota",
+			config: settingsv1alpha1.SettingsQuotaConfig{Spec: corev1.ResourceQuotaSpec{Hard: resourceList("cpu", "2")}},
+			quotas: []settingsv1alpha1.NamedResourceQuota{{Name: QtName, Spec: corev1.ResourceQuotaSpec{Hard: resourceList("cpu", "2")}}},
+		},
+		{
+			name:      "single quota with overrides",
+			config:    settingsv1alpha1.SettingsQuotaConfig{Spec: corev1.ResourceQuotaSpec{Hard: resourceList("cpu", "2")}},
+			overrides: resourceList("cpu", "3", "pods", "10"),
+			quotas:    []settingsv1alpha1.NamedResourceQuota{{Name: QtName, Spec: corev1.ResourceQuotaSpec{Hard: resourceList("cpu", "3", "pods", "10")}}},
+		},
+		{
+			name:      "empty single quota with overrides",
+			overrides: resourceList("pods", "10"),
+			quotas:    []settingsv1alpha1.NamedResourceQuota{{Name: QtName, Spec: corev1.ResourceQuotaSpec{Hard: resourceList("pods", "10")}}},
+		},
+		{
+			name:   "named quotas",
+			config: named,
+			quotas: named.Quotas,
+		},
+		{
+			name:      "named quotas with overrides",
+			config:    named,
+			overrides: resourceList("cpu", "8", "pods", "10"),
+			quotas: []settingsv1alpha1.NamedResourceQuota{
+				{Name: "compute", Spec: corev1.ResourceQuotaSpec{Hard: resourceList("cpu", "8", "memory", "4Gi", "pods", "10")}},
+				{Name: "objects", Spec: corev1.ResourceQuotaSpec{Hard: resourceList("count/pipelineruns.tekton.dev", "100", "cpu", "8")}},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := *tt.config.DeepCopy()
+			quotas := resourceQuotas(config, tt.overrides)
+			if !equality.Semantic.DeepEqual(quotas, tt.quotas) {
+				t.Errorf("resourceQuotas() = %+v, expected %+v", quotas, tt.quotas)
+			}
+			if !equality.Semantic.DeepEqual(config, tt.config) {
+				t.Errorf("the configuration has been modified: %+v", config)
+			}
+		})
+	}
+}
+
+func TestQuotaOverrides(t *testing.T) {
+	overrides := []settingsv1alpha1.SettingsQuotaOverride{
+		{Workspace: "root:org:a", Hard: resourceList("count/pipelineruns.tekton.dev", "80", "cpu", "4", "pods", "10")},
+		{Workspace: "root:org:b", Hard: resourceList("count/pipelineruns.tekton.dev", "20")},
+	}
+	tests := []struct {
+		name      string
+		max       corev1.ResourceList
+		workspace string
+		overrides corev1.ResourceList
+		clamped   []string
+	}{
+		{name: "workspace without overrides", max: resourceList("pods", "5"), workspace: "root:org:c"},
+		{
+			name:      "no maxima",
+			workspace: "root:org:a",
+			overrides: resourceList("count/pipelineruns.tekton.dev", "80", "cpu", "4", "pods", "10"),
+		},
+		{
+			name:      "within the maxima",
+			max:       resourceList("count/pipelineruns.tekton.dev", "50"),
+			workspace: "root:org:b",
+			overrides: resourceList("count/pipelineruns.tekton.dev", "20"),
+		},
+		{
+			name:      "above the maxima",
+			max:       resourceList("count/pipelineruns.tekton.dev", "50", "pods", "20"),
+			workspace: "root:org:a",
+			overrides: resourceList("count/pipelineruns.tekton.dev", "50", "pods", "10"),
+			clamped:   []string{"count/pipelineruns.tekton.dev lowered from 80 to 50", "cpu cannot be overridden"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := &settingsv1alpha1.SettingsConfig{MaxQuotaOverrides: tt.max, QuotaOverrides: overrides}
+			hard, clamped := quotaOverrides(config, tt.workspace)
+			if !equality.Semantic.DeepEqual(hard, tt.overrides) {
+				t.Errorf("quotaOverrides() = %v, expected %v", hard, tt.overrides)
+			}
+			if !reflect.DeepEqual(clamped, tt.clamped) {
+				t.Errorf("quotaOverrides() clamped %v, expected %v", clamped, tt.clamped)
+			}
+		})
+	}
+}
+
+func TestQuotaStatus(t *testing.T) {
+	tests := []struct {
+		name       string
+		hard       corev1.ResourceList
+		used       corev1.ResourceList
+		percentage map[corev1.ResourceName]int64
+	}{
+		{name: "no status"},
+		{
+			name:       "usage",
+			hard:       resourceList("cpu", "2", "memory", "4Gi", "pods", "10"),
+			used:       resourceList("cpu", "500m", "memory", "1Gi"),
+			percentage: map[corev1.ResourceName]int64{"cpu": 25, "memory": 25},
+		},
+		{
+			name:       "zero hard limit",
+			hard:       resourceList("count/deployments.apps", "0", "pods", "10"),
+			used:       resourceList("count/deployments.apps", "0", "pods", "10"),
+			percentage: map[corev1.ResourceName]int64{"pods": 100},
+		},
+		{
+			name:       "usage above the hard limit",
+			hard:       resourceList("pods", "10"),
+			used:       resourceList("pods", "15"),
+			percentage: map[corev1.ResourceName]int64{"pods": 150},
+		},
+		{
+			// The milli values of these quantities overflow int64.
+			name:       "large quantities",
+			hard:       resourceList("ephemeral-storage", "8Ei"),
+			used:       resourceList("ephemeral-storage", "4Ei"),
+			percentage: map[corev1.ResourceName]int64{"ephemeral-storage": 50},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quota := &corev1.ResourceQuota{Status: corev1.ResourceQuotaStatus{Hard: tt.hard, Used: tt.used}}
+			quota.Name = "compute"
+			status := quotaStatus(quota)
+			if status.Name != "compute" || !equality.Semantic.DeepEqual(status.Hard, tt.hard) || !equality.Semantic.DeepEqual(status.Used, tt.used) {
+				t.Errorf("quotaStatus() = %+v, expected the name, hard limits and usage of the quota", status)
+			}
+			if !reflect.DeepEqual(status.UsedPercentage, tt.percentage) {
+				t.Errorf("quotaStatus() percentages = %v, expected %v", status.UsedPercentage, tt.percentage)
+			}
+		})
+	}
+}
+
+func TestApply(t *testing.T) {
+	tests := []struct {
+		name string
+		// whether the live object is controlled by the APIBinding
+		controlled bool
+		// field manager, which last applied the live object, it is created with an update otherwise
+		appliedBy string
+		conflict  bool
+		pods      string
+	}{
+		{name: "created by a previous version of the controller", controlled: true, pods: "10"},
+		{name: "created by another writer", conflict: true, pods: "20"},
+		{name: "applied by the controller", controlled: true, appliedBy: FieldManager, conflict: true, pods: "20"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ab := newTestAPIBinding()
+			r := newTestReconciler(t, nil, ab)
+			ctx := context.Background()
+
+			quota := func(pods string) *corev1.ResourceQuota {
+				q := &corev1.ResourceQuota{
+					TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ResourceQuota"},
+					ObjectMeta: metav1.ObjectMeta{Namespace: "pipelines", Name: QtName},
+					Spec:       corev1.ResourceQuotaSpec{Hard: resourceList("pods", pods)},
+				}
+				if tt.controlled {
+					controlledBy(t, ab, q)
+				}
+				return q
+			}
+			if tt.appliedBy != "" {
+				if err := r.Patch(ctx, quota("10"), client.Apply, client.FieldOwner(tt.appliedBy)); err != nil {
+					t.Fatal(err)
+				}
+				// A tenant takes the ownership of the field with an update.
+				var live corev1.ResourceQuota
+				if err := r.Get(ctx, types.NamespacedName{Namespace: "pipelines", Name: QtName}, &live); err != nil {
+					t.Fatal(err)
+				}
+				live.Spec.Hard = resourceList("pods", "20")
+				if err := r.Update(ctx, &live, client.FieldOwner("kubectl-edit")); err != nil {
+					t.Fatal(err)
+				}
+			} else if err := r.Create(ctx, quota("20"), client.FieldOwner("kubectl-create")); err != nil {
+				t.Fatal(err)
+			}
+
+			var live corev1.ResourceQuota
+			if err := r.Get(ctx, types.NamespacedName{Namespace: "pipelines", Name: QtName}, &live); err != nil {
+				t.Fatal(err)
+			}
+			desired := quota("10")
+			controlledBy(t, ab, desired)
+			result, err := r.apply(ctx, ab, desired, &live)
+			if isConflict(err) != tt.conflict {
+				t.Fatalf("apply() error = %v, expected a conflict: %t", err, tt.conflict)
+			}
+			if !tt.conflict && result != cutil.OperationResultUpdated {
+				t.Errorf("apply() = %q, expected %q", result, cutil.OperationResultUpdated)
+			}
+
+			var applied corev1.ResourceQuota
+			if err := r.Get(ctx, types.NamespacedName{Namespace: "pipelines", Name: QtName}, &applied); err != nil {
+				t.Fatal(err)
+			}
+			if pods := applied.Spec.Hard["pods"]; pods.String() != tt.pods {
+				t.Errorf("the quota has %s pods, expected %s", pods.String(), tt.pods)
+			}
+			if controlled := metav1.IsControlledBy(&applied, ab); controlled != tt.controlled {
+				t.Errorf("the quota is controlled by the APIBinding: %t, expected %t", controlled, tt.controlled)
+			}
+			if applied := appliedByController(&applied); applied != (tt.appliedBy != "" || !tt.conflict) {
+				t.Errorf("the quota has been applied by the controller: %t", applied)
+			}
+		})
+	}
+}
+
+func TestReconcileNetworkPolicies(t *testing.T) {
+	ab := newTestAPIBinding()
+	r := newTestReconciler(t, nil, ab,
+		controlledBy(t, ab, &netv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: "pipelines", Name: "default-deny"}}),
+	)
+	config := settingsv1alpha1.SettingsNetPolConfig{Policies: []settingsv1alpha1.NamedNetworkPolicy{
+		{Name: "default-deny", Spec: netv1.NetworkPolicySpec{PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeIngress}}},
+		{Name: "allow-dns", Spec: netv1.NetworkPolicySpec{PolicyTypes: []netv1.PolicyType{netv1.PolicyTypeEgress}}},
+	}}
+
+	ctx := context.Background()
+	inv := newInventory(nil)
+	if err := r.reconcileNetworkPolicies(ctx, ab, "pipelines", config, &driftReport{}, nil, inv); err != nil {
+		t.Fatalf("reconcileNetworkPolicies() failed: %v", err)
+	}
+	for _, expected := range config.Policies {
+		var np netv1.NetworkPolicy
+		if err := r.Get(ctx, types.NamespacedName{Namespace: "pipelines", Name: expected.Name}, &np); err != nil {
+			t.Fatalf("unable to get the NetworkPolicy %q: %v", expected.Name, err)
+		}
+		if !equality.Semantic.DeepEqual(np.Spec, expected.Spec) || !metav1.IsControlledBy(&np, ab) {
+			t.Errorf("unexpected NetworkPolicy %q: %+v", expected.Name, np)
+		}
+	}
+	var names []string
+	for _, res := range inv.resources() {
+		names = append(names, res.Name)
+	}
+	if !reflect.DeepEqual(names, []string{"allow-dns", "default-deny"}) {
+		t.Errorf("NetworkPolicies in the inventory: %v", names)
+	}
+}
+
+func TestReconcileLimitRange(t *testing.T) {
+	limits := []corev1.LimitRangeItem{{Type: corev1.LimitTypeContainer, DefaultRequest: resourceList("cpu", "100m")}}
+	tests := []struct {
+		name   string
+		limits []corev1.LimitRangeItem
+	}{
+		{name: "limits configured", limits: limits},
+		{name: "no limit configured"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ab := newTestAPIBinding()
+			r := newTestReconciler(t, nil, ab, controlledBy(t, ab, &corev1.LimitRange{ObjectMeta: metav1.ObjectMeta{Namespace: "pipelines", Name: LrName}}))
+			config := settingsv1alpha1.SettingsLimitRangeConfig{Spec: corev1.LimitRangeSpec{Limits: tt.limits}}
+
+			ctx := context.Background()
+			inv := newInventory(nil)
+			if err := r.reconcileLimitRange(ctx, ab, "pipelines", config, &driftReport{}, nil, inv); err != nil {
+				t.Fatalf("reconcileLimitRange() failed: %v", err)
+			}
+			// Without limits the LimitRange is left out of the inventory to get pruned.
+			if recorded := len(inv.resources()) > 0; recorded != (tt.limits != nil) {
+				t.Errorf("LimitRange recorded in the inventory: %t, expected %t", recorded, tt.limits != nil)
+			}
+			if tt.limits == nil {
+				return
+			}
+			var lr corev1.LimitRange
+			if err := r.Get(ctx, types.NamespacedName{Namespace: "pipelines", Name: LrName}, &lr); err != nil {
+				t.Fatalf("unable to get the LimitRange: %v", err)
+			}
+			if !equality.Semantic.DeepEqual(lr.Spec.Limits, tt.limits) {
+				t.Errorf("LimitRange limits = %+v, expected %+v", lr.Spec.Limits, tt.limits)
+			}
+		})
+	}
+}
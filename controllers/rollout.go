@@ -0,0 +1,107 @@
+package controllers
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// DefaultRolloutPercentage is the percentage of the workspaces getting the new configuration when it is not specified.
+const DefaultRolloutPercentage int32 = 100
+
+// healthyConditions are the conditions of the Settings, which need to be True for a canary workspace to be healthy.
+var healthyConditions = []string{"NetworkPoliciesReady", "QuotasReady", "LimitRangesReady"}
+
+// isCanary returns whether the APIBinding of the workspace is selected as a canary by the rollout strategy.
+func isCanary(strategy *settingsv1alpha1.SettingsRolloutStrategy, ab *apisv1alpha1.APIBinding) (bool, error) {
+	if strategy == nil || strategy.CanarySelector == nil {
+		return false, nil
+	}
+	selector, err := metav1.LabelSelectorAsSelector(strategy.CanarySelector)
+	if err != nil {
+		return false, err
+	}
+	return selector.Matches(labels.Set(ab.GetLabels())), nil
+}
+
+// rolloutBlocked returns the reason and the message explaining why a new configuration cannot be applied
+// to the workspace yet, or an empty reason when it can be.
+func rolloutBlocked(strategy *settingsv1alpha1.SettingsRolloutStrategy, export, workspace string, canary bool, configHash string) (string, string) {
+	if strategy == nil {
+		return "", ""
+	}
+	if strategy.Paused {
+		return "RolloutPaused", "The rollout of the new configuration is paused"
+	}
+	if canary {
+		return "", ""
+	}
+	if strategy.CanarySelector != nil {
+		if known, pending := workspaces.unhealthyCanaries(export, configHash); known == 0 {
+			return "CanariesNotHealthy", "Waiting for a canary workspace to get the new configuration"
+		} else if len(pending) > 0 {
+			return "CanariesNotHealthy", fmt.Sprintf("Waiting for the canary workspaces to be healthy with the new configuration: %s", strings.Join(pending, ", "))
+		}
+	}
+	if percentage := rolloutPercentage(strategy); rolloutBucket(workspace) >= percentage {
+		return "OutsideRolloutPercentage", fmt.Sprintf("The new configuration is rolled out to %d%% of the workspaces", percentage)
+	}
+	return "", ""
+}
+
+// rolloutPercentage returns the configured percentage of the rollout strategy or its default value.
+func rolloutPercentage(strategy *settingsv1alpha1.SettingsRolloutStrategy) int32 {
+	if strategy.Percentage == nil {
+		return DefaultRolloutPercentage
+	}
+	return *strategy.Percentage
+}
+
+// rolloutBucket spreads the workspaces between 0 and 99 so that they are consistently selected
+// as the rollout percentage increases.
+func rolloutBucket(workspace string) int32 {
+	h := fnv.New32a()
+	h.Write([]byte(workspace))
+	return int32(h.Sum32() % 100)
+}
+
+// unhealthyCanaries returns the number of canary workspaces of the APIExport known to the controller and the ones,
+// which are not on the configuration or whose Settings conditions are not healthy.
+func (t *workspaceTracker) unhealthyCanaries(export, configHash string) (int, []string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	known := 0
+	var pending []string
+	for key, state := range t.states {
+		if key.export != export || !state.canary {
+			continue
+		}
+		known++
+		if state.configHash != configHash {
+			pending = append(pending, key.workspace)
+			continue
+		}
+		for _, conditionType := range healthyConditions {
+			if state.conditions[conditionType].Status != metav1.ConditionTrue {
+				pending = append(pending, key.workspace)
+				break
+			}
+		}
+	}
+	sort.Strings(pending)
+	return known, pending
+}
+
+// canariesHealthy returns whether canary workspaces of the APIExport are known and all healthy with the configuration.
+func (t *workspaceTracker) canariesHealthy(export, configHash string) bool {
+	known, pending := t.unhealthyCanaries(export, configHash)
+	return known > 0 && len(pending) == 0
+}
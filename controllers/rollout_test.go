@@ -0,0 +1,315 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// percentage returns a pointer to the rollout percentage.
+func percentage(p int32) *int32 {
+	return &p
+}
+
+// healthyStatus returns the status of a Settings, on the configuration, whose conditions are healthy
+// unless listed as unhealthy.
+func healthyStatus(configHash string, unhealthy ...string) settingsv1alpha1.SettingsStatus {
+	status := settingsv1alpha1.SettingsStatus{ConfigHash: configHash}
+	for _, conditionType := range healthyConditions {
+		condition := metav1.Condition{Type: conditionType, Status: metav1.ConditionTrue}
+		for _, u := range unhealthy {
+			if u == conditionType {
+				condition.Status = metav1.ConditionFalse
+			}
+		}
+		status.Conditions = append(status.Conditions, condition)
+	}
+	return status
+}
+
+func TestIsCanary(t *testing.T) {
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"canary": "true"}}
+	tests := []struct {
+		name     string
+		strategy *settingsv1alpha1.SettingsRolloutStrategy
+		labels   map[string]string
+		canary   bool
+		err      bool
+	}{
+		{name: "no strategy", labels: map[string]string{"canary": "true"}},
+		{name: "no selector", strategy: &settingsv1alpha1.SettingsRolloutStrategy{}, labels: map[string]string{"canary": "true"}},
+		{name: "selected", strategy: &settingsv1alpha1.SettingsRolloutStrategy{CanarySelector: selector}, labels: map[string]string{"canary": "true"}, canary: true},
+		{name: "not selected", strategy: &settingsv1alpha1.SettingsRolloutStrategy{CanarySelector: selector}},
+		{
+			name: "invalid selector",
+			strategy: &settingsv1alpha1.SettingsRolloutStrategy{CanarySelector: &metav1.LabelSelector{
+				MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "canary", Operator: "Near"}},
+			}},
+			err: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ab := &apisv1alpha1.APIBinding{ObjectMeta: metav1.ObjectMeta{Labels: tt.labels}}
+			canary, err := isCanary(tt.strategy, ab)
+			if (err != nil) != tt.err {
+				t.Fatalf("isCanary() error = %v, expected an error: %t", err, tt.err)
+			}
+			if canary != tt.canary {
+				t.Errorf("isCanary() = %t, expected %t", canary, tt.canary)
+			}
+		})
+	}
+}
+
+func TestRolloutBlocked(t *testing.T) {
+	selector := &metav1.LabelSelector{MatchLabels: map[string]string{"canary": "true"}}
+	tests := []struct {
+		name     string
+		strategy *settingsv1alpha1.SettingsRolloutStrategy
+		// statuses of the canary workspaces
+		canaries []settingsv1alpha1.SettingsStatus
+		canary   bool
+		reason   string
+	}{
+		{name: "no strategy"},
+		{name: "paused", strategy: &settingsv1alpha1.SettingsRolloutStrategy{Paused: true}, canary: true, reason: "RolloutPaused"},
+		{name: "canary", strategy: &settingsv1alpha1.SettingsRolloutStrategy{CanarySelector: selector}, canary: true},
+		{
+			name:     "healthy canaries",
+			strategy: &settingsv1alpha1.SettingsRolloutStrategy{CanarySelector: selector},
+			canaries: []settingsv1alpha1.SettingsStatus{healthyStatus("new"), healthyStatus("new")},
+		},
+		{
+			name:     "unhealthy canary",
+			strategy: &settingsv1alpha1.SettingsRolloutStrategy{CanarySelector: selector},
+			canaries: []settingsv1alpha1.SettingsStatus{healthyStatus("new"), healthyStatus("new", "QuotasReady")},
+			reason:   "CanariesNotHealthy",
+		},
+		{
+			name:     "canary on the previous configuration",
+			strategy: &settingsv1alpha1.SettingsRolloutStrategy{CanarySelector: selector},
+			canaries: []settingsv1alpha1.SettingsStatus{healthyStatus("old")},
+			reason:   "CanariesNotHealthy",
+		},
+		{name: "no canary", strategy: &settingsv1alpha1.SettingsRolloutStrategy{CanarySelector: selector}, reason: "CanariesNotHealthy"},
+		{name: "within the percentage", strategy: &settingsv1alpha1.SettingsRolloutStrategy{Percentage: percentage(100)}},
+		{name: "default percentage", strategy: &settingsv1alpha1.SettingsRolloutStrategy{}},
+		{name: "outside the percentage", strategy: &settingsv1alpha1.SettingsRolloutStrategy{Percentage: percentage(0)}, reason: "OutsideRolloutPercentage"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tracker := newTestWorkspaces(t)
+			for i, status := range tt.canaries {
+				tracker.set(testExportName, fmt.Sprintf("root:org:canary-%d/settings", i), status, true)
+			}
+			tracker.set(testExportName, "root:org:other/settings", healthyStatus("old"), false)
+			// The canaries of another APIExport are not taken into account.
+			tracker.set("other-export", "root:org:other-canary/settings", healthyStatus("old"), true)
+
+			reason, _ := rolloutBlocked(tt.strategy, testExportName, "root:org:ws/settings", tt.canary, "new")
+			if reason != tt.reason {
+				t.Errorf("rolloutBlocked() = %q, expected %q", reason, tt.reason)
+			}
+		})
+	}
+}
+
+func TestUnhealthyCanaries(t *testing.T) {
+	tracker := newTestWorkspaces(t)
+	tracker.set(testExportName, "healthy", healthyStatus("new"), true)
+	tracker.set(testExportName, "degraded", healthyStatus("new", "NetworkPoliciesReady"), true)
+	tracker.set(testExportName, "late", healthyStatus("old"), true)
+	tracker.set(testExportName, "other", healthyStatus("old"), false)
+	tracker.set("other-export", "late", healthyStatus("old"), true)
+
+	known, pending := tracker.unhealthyCanaries(testExportName, "new")
+	if known != 3 {
+		t.Errorf("expected 3 known canaries, got %d", known)
+	}
+	if expected := []string{"degraded", "late"}; !reflect.DeepEqual(pending, expected) {
+		t.Errorf("unhealthyCanaries() = %v, expected %v", pending, expected)
+	}
+	if tracker.canariesHealthy(testExportName, "new") {
+		t.Errorf("canariesHealthy() = true with unhealthy canaries")
+	}
+
+	tracker.delete(testExportName, "degraded")
+	tracker.set(testExportName, "late", healthyStatus("new"), true)
+	if !tracker.canariesHealthy(testExportName, "new") {
+		t.Errorf("canariesHealthy() = false with healthy canaries")
+	}
+	// Without canary, the canaries are not considered healthy.
+	if tracker.canariesHealthy("unknown-export", "new") {
+		t.Errorf("canariesHealthy() = true without canary")
+	}
+}
+
+func TestRolloutBucket(t *testing.T) {
+	counts := make([]int, 100)
+	for i := 0; i < 10000; i++ {
+		workspace := fmt.Sprintf("root:org:ws-%d", i)
+		bucket := rolloutBucket(workspace)
+		if bucket < 0 || bucket > 99 {
+			t.Fatalf("rolloutBucket(%q) = %d, expected a value between 0 and 99", workspace, bucket)
+		}
+		if again := rolloutBucket(workspace); again != bucket {
+			t.Fatalf("rolloutBucket(%q) is not stable: %d then %d", workspace, bucket, again)
+		}
+		counts[bucket]++
+	}
+	// The workspaces are roughly evenly spread so that the percentage of the rollout is meaningful.
+	for bucket, count := range counts {
+		if count < 50 || count > 150 {
+			t.Errorf("bucket %d has %d workspaces out of 10000", bucket, count)
+		}
+	}
+}
+
+func TestReconcileRollout(t *testing.T) {
+	newTestWorkspaces(t)
+	previous := managedConfig("100")
+	rt := newReconcileTest(t, previous, requiredClaims())
+	if _, _, err := rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	previousHash, _ := configHash(previous)
+
+	pipelineRuns := func() int64 {
+		var quota corev1.ResourceQuota
+		rt.get(previous.Namespace, QtName, &quota)
+		q := quota.Spec.Hard["count/pipelineruns.tekton.dev"]
+		return q.Value()
+	}
+
+	// The workspace is outside of the rollout percentage: it keeps the previous configuration.
+	config := managedConfig("200")
+	config.Rollout = &settingsv1alpha1.SettingsRolloutStrategy{Percentage: percentage(0)}
+	rt.r.CtrlConfig.Set(config)
+	result, s, err := rt.reconcile()
+	if err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	rt.expectCondition(s, "ConfigRolledOut", metav1.ConditionFalse, "OutsideRolloutPercentage")
+	if s.Status.ConfigHash != previousHash {
+		t.Errorf("config hash is %q, expected the previous one %q", s.Status.ConfigHash, previousHash)
+	}
+	// The workspace is enqueued again when the rollout strategy changes rather than periodically.
+	if result.Requeue || result.RequeueAfter != 0 {
+		t.Errorf("the workspace is requeued: %+v", result)
+	}
+	if q := pipelineRuns(); q != 100 {
+		t.Errorf("the new configuration has been applied: %d", q)
+	}
+
+	// The workspace is still reconciled against the configuration last applied to it.
+	if err := rt.r.Delete(context.Background(), &netv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: previous.Namespace, Name: NpName}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, s, err = rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	rt.get(previous.Namespace, NpName, &netv1.NetworkPolicy{})
+	rt.expectCondition(s, "ConfigRolledOut", metav1.ConditionFalse, "OutsideRolloutPercentage")
+	if s.Status.ConfigHash != previousHash {
+		t.Errorf("config hash is %q, expected the previous one %q", s.Status.ConfigHash, previousHash)
+	}
+
+	// The quota overrides of the workspace are applied without waiting for the rollout.
+	config.QuotaOverrides = []settingsv1alpha1.SettingsQuotaOverride{{Workspace: "root:org:ws", Hard: resourceList("count/pipelineruns.tekton.dev", "150")}}
+	rt.r.CtrlConfig.Set(config)
+	if _, s, err = rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	rt.expectCondition(s, "ConfigRolledOut", metav1.ConditionFalse, "OutsideRolloutPercentage")
+	if s.Status.ConfigHash != previousHash {
+		t.Errorf("config hash is %q, expected the previous one %q", s.Status.ConfigHash, previousHash)
+	}
+	if q := pipelineRuns(); q != 150 {
+		t.Errorf("the quota override has not been applied: %d", q)
+	}
+	config.QuotaOverrides = nil
+	rt.r.CtrlConfig.Set(config)
+
+	// The configuration last applied is not known after a restart: the workspace is left untouched.
+	store := rt.r.CtrlConfig
+	rt.r.CtrlConfig = NewConfigStore(config)
+	if err := rt.r.Delete(context.Background(), &netv1.NetworkPolicy{ObjectMeta: metav1.ObjectMeta{Namespace: previous.Namespace, Name: NpName}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, s, err = rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	rt.expectCondition(s, "ConfigRolledOut", metav1.ConditionFalse, "OutsideRolloutPercentage")
+	if err := rt.r.Get(context.Background(), types.NamespacedName{Namespace: previous.Namespace, Name: NpName}, &netv1.NetworkPolicy{}); !errors.IsNotFound(err) {
+		t.Errorf("the workspace has been reconciled against an unknown configuration: %v", err)
+	}
+	rt.r.CtrlConfig = store
+
+	// The rollout is paused.
+	config.Rollout = &settingsv1alpha1.SettingsRolloutStrategy{Paused: true}
+	rt.r.CtrlConfig.Set(config)
+	if _, s, err = rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	rt.expectCondition(s, "ConfigRolledOut", metav1.ConditionFalse, "RolloutPaused")
+
+	// The rollout is completed.
+	config.Rollout = &settingsv1alpha1.SettingsRolloutStrategy{Percentage: percentage(100)}
+	rt.r.CtrlConfig.Set(config)
+	if _, s, err = rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	rt.expectCondition(s, "ConfigRolledOut", metav1.ConditionTrue, "ConfigApplied")
+	if h, _ := configHash(config); s.Status.ConfigHash != h {
+		t.Errorf("config hash is %q, expected %q", s.Status.ConfigHash, h)
+	}
+	if q := pipelineRuns(); q != 200 {
+		t.Errorf("the new configuration has not been applied: %d", q)
+	}
+}
+
+func TestReconcileCanariesHealthy(t *testing.T) {
+	newTestWorkspaces(t)
+	config := managedConfig("100")
+	config.Rollout = &settingsv1alpha1.SettingsRolloutStrategy{CanarySelector: &metav1.LabelSelector{MatchLabels: map[string]string{"canary": "true"}}}
+	rt := newReconcileTest(t, config, requiredClaims())
+	var ab apisv1alpha1.APIBinding
+	rt.get("", rt.ab.Name, &ab)
+	ab.Labels = map[string]string{"canary": "true"}
+	if err := rt.r.Update(context.Background(), &ab); err != nil {
+		t.Fatal(err)
+	}
+	notified := 0
+	rt.r.OnCanariesHealthy = func() { notified++ }
+
+	// The waiting workspaces are notified once when the canary becomes healthy.
+	for i := 0; i < 2; i++ {
+		if _, _, err := rt.reconcile(); err != nil {
+			t.Fatalf("reconcile failed: %v", err)
+		}
+		if notified != 1 {
+			t.Errorf("notified %d times after reconciliation %d, expected once", notified, i+1)
+		}
+	}
+
+	// The canary becomes healthy with a new configuration.
+	config.QuotaConfig.Spec.Hard = resourceList("count/pipelineruns.tekton.dev", "200")
+	rt.r.CtrlConfig.Set(config)
+	if _, _, err := rt.reconcile(); err != nil {
+		t.Fatalf("reconcile failed: %v", err)
+	}
+	if notified != 2 {
+		t.Errorf("notified %d times after the new configuration, expected twice", notified)
+	}
+}
@@ -3,18 +3,27 @@ package controllers
 import (
 	"context"
 	"fmt"
+	"reflect"
+	"strings"
 	"time"
 
 	"github.com/kcp-dev/logicalcluster/v2"
 	corev1 "k8s.io/api/core/v1"
 	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 	cutil "sigs.k8s.io/controller-runtime/pkg/controller/controllerutil"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/source"
 
 	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
 	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
@@ -22,17 +31,44 @@ import (
 
 type SettingsReconciler struct {
 	client.Client
-	Scheme          *runtime.Scheme
-	CtrlConfig      settingsv1alpha1.SettingsConfig
-	ExportWorkspace string
-	ExportName      string
+	Scheme     *runtime.Scheme
+	CtrlConfig *ConfigStore
+	// ExportName is the name of the APIExport, used in the metrics
+	ExportName string
+	// ExportIdentityHash is the identity of the APIExport. The APIBindings are matched on it
+	// rather than on the path of the APIExport workspace, which can differ between equivalent references.
+	ExportIdentityHash string
+	// OnCanariesHealthy is called when the canary workspaces become healthy with a new configuration so that
+	// the workspaces waiting for it get reconciled. It must not block.
+	OnCanariesHealthy func()
+
+	// configEvents is used to trigger the reconciliation of APIBindings when the configuration changes.
+	configEvents chan event.GenericEvent
 }
 
 const SettingName = "pipeline-service"
 const NpName = "hermetic-build"
 const QtName = "settings"
+const LrName = "settings"
+
+// FieldManager is the field manager used by the controller for server-side apply.
+const FieldManager = "settings-controller"
 const QuotaAnnotation = "\"experimental.quota.kcp.dev/cluster-scoped\": \"true\""
 
+// ProfileAnnotation can be set on the APIBinding to select the settings profile of the workspace.
+const ProfileAnnotation = "configuration.pipeline-service.io/profile"
+
+// ManagedByLabel is set on the namespaces created by the controller. It allows recognizing them when they have
+// been orphaned, when the workspace was unbound with the Orphan cleanup policy, and the workspace gets bound again.
+const ManagedByLabel = "configuration.pipeline-service.io/managed-by"
+
+// NamespaceRequeuePeriod is the period after which a workspace skipped because of its namespace is reconciled again.
+const NamespaceRequeuePeriod = 5 * time.Minute
+
+// APIBindingExportIndex is the name of the cache index of the APIBindings by the identity of the APIExports
+// whose resources they bind.
+const APIBindingExportIndex = "status.boundResources.schema.identityHash"
+
 // +kubebuilder:rbac:groups="networking.k8s.io",resources=networkpolicies,verbs=get;list;watch;create;update;patch;delete
 // +kubebuilder:rbac:groups="networking.k8s.io",resources=networkpolicies/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups="networking.k8s.io",resources=networkpolicies/finalizers,verbs=update
@@ -41,7 +77,13 @@ const QuotaAnnotation = "\"experimental.quota.kcp.dev/cluster-scoped\": \"true\"
 // +kubebuilder:rbac:groups="",resources=resourcequotas/status,verbs=get;update;patch
 // +kubebuilder:rbac:groups="",resources=resourcequotas/finalizers,verbs=update
 
-// +kubebuilder:rbac:groups="apis.kcp.dev",resources=apibindings,verbs=get;list;watch
+// +kubebuilder:rbac:groups="",resources=limitranges,verbs=get;list;watch;create;update;patch;delete
+
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch;create;update;patch;delete
+
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+
+// +kubebuilder:rbac:groups="apis.kcp.dev",resources=apibindings,verbs=get;list;watch;update;patch
 // +kubebuilder:rbac:groups="apis.kcp.dev",resources=apibindings/status,verbs=get
 // +kubebuilder:rbac:groups="apis.kcp.dev",resources=apibindings/finalizers,verbs=update
 
@@ -57,30 +99,63 @@ func (r *SettingsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 	// there.
 	logger = logger.WithValues("clusterName", req.ClusterName)
 	logger.V(0).Info("Starting reconcile")
+	ctx = ctrl.LoggerInto(ctx, logger)
 
 	// Add the logical cluster to the context
 	ctx = logicalcluster.WithCluster(ctx, logicalcluster.New(req.ClusterName))
 
+	// The configuration may be reloaded during the reconciliation, a consistent copy is used.
+	ctrlConfig := r.CtrlConfig.Get()
+	cHash, err := configHash(ctrlConfig)
+	if err != nil {
+		return ctrl.Result{}, r.recordReconcileError("hash", err)
+	}
+
+	// Key of the workspace for the metrics
+	workspace := req.ClusterName + "/" + req.Name
+
 	logger.V(3).Info("Getting APIBinding", "NamespacedName", req.NamespacedName)
 	var ab apisv1alpha1.APIBinding
 	if err := r.Get(ctx, req.NamespacedName, &ab); err != nil {
 		if errors.IsNotFound(err) {
 			// Normal - was deleted
-			// Rely on owner references for cascading deletion
+			// The managed resources have been cleaned up before the finalizer got removed.
+			workspaces.delete(r.ExportName, workspace)
 			return ctrl.Result{}, nil
 		}
-		return ctrl.Result{}, err
+		return ctrl.Result{}, r.recordReconcileError("apibinding", err)
 	}
 
-	// Only process the relevant APIBinding
-	// It may go away if kcp makes it possible to only watch APIBindings
-	// for the specified APIExport.
-	if ab.Spec.Reference.Workspace.ExportName != r.ExportName ||
-		ab.Spec.Reference.Workspace.Path != r.ExportWorkspace {
-		logger.V(3).Info("APIBinding excluded", "NamespacedName", req.NamespacedName)
+	// Resources whose permission claims have not been accepted cannot be accessed and are skipped.
+	claims := acceptedPermissionClaims(&ab)
+
+	if !ab.GetDeletionTimestamp().IsZero() {
+		if err := r.cleanup(ctx, &ab, &ctrlConfig, claims); err != nil {
+			return ctrl.Result{}, r.recordReconcileError("cleanup", err)
+		}
+		workspaces.delete(r.ExportName, workspace)
 		return ctrl.Result{}, nil
 	}
 
+	if !cutil.ContainsFinalizer(&ab, CleanupFinalizer) {
+		logger.V(3).Info("Adding the cleanup finalizer to the APIBinding")
+		patch := client.MergeFrom(ab.DeepCopy())
+		cutil.AddFinalizer(&ab, CleanupFinalizer)
+		if err := r.Patch(ctx, &ab, patch); err != nil {
+			return ctrl.Result{}, r.recordReconcileError("finalizer", err)
+		}
+	}
+
+	nsCondition := metav1.Condition{
+		Type:   "NamespaceReady",
+		Status: metav1.ConditionUnknown,
+		LastTransitionTime: metav1.Time{
+			Time: time.Now().UTC(),
+		},
+		Reason:  "Unknown",
+		Message: "Unknown",
+	}
+
 	npCondition := metav1.Condition{
 		Type:   "NetworkPoliciesReady",
 		Status: metav1.ConditionUnknown,
@@ -101,6 +176,62 @@ func (r *SettingsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 		Message: "Unknown",
 	}
 
+	driftCondition := metav1.Condition{
+		Type:   "DriftDetected",
+		Status: metav1.ConditionUnknown,
+		LastTransitionTime: metav1.Time{
+			Time: time.Now().UTC(),
+		},
+		Reason:  "Unknown",
+		Message: "Unknown",
+	}
+
+	pressureCondition := metav1.Condition{
+		Type:   "QuotaPressure",
+		Status: metav1.ConditionUnknown,
+		LastTransitionTime: metav1.Time{
+			Time: time.Now().UTC(),
+		},
+		Reason:  "Unknown",
+		Message: "Unknown",
+	}
+
+	lrCondition := metav1.Condition{
+		Type:   "LimitRangesReady",
+		Status: metav1.ConditionUnknown,
+		LastTransitionTime: metav1.Time{
+			Time: time.Now().UTC(),
+		},
+		Reason:  "Unknown",
+		Message: "Unknown",
+	}
+
+	rolloutCondition := metav1.Condition{
+		Type:   "ConfigRolledOut",
+		Status: metav1.ConditionUnknown,
+		LastTransitionTime: metav1.Time{
+			Time: time.Now().UTC(),
+		},
+		Reason:  "Unknown",
+		Message: "Unknown",
+	}
+
+	claimsCondition := metav1.Condition{
+		Type:   "PermissionClaimsAccepted",
+		Status: metav1.ConditionTrue,
+		LastTransitionTime: metav1.Time{
+			Time: time.Now().UTC(),
+		},
+		Reason:  "ClaimsAccepted",
+		Message: "All permission claims have been accepted",
+	}
+	if missing := claims.missing(); len(missing) > 0 {
+		logger.V(1).Info("Permission claims not accepted", "claims", missing)
+		claimsCondition.Status = metav1.ConditionFalse
+		claimsCondition.Reason = "ClaimsNotAccepted"
+		claimsCondition.Message = fmt.Sprintf("Permission claims not accepted: %s", strings.Join(missing, ", "))
+	}
+
 	// get the settings associated with the apibinding
 	var s settingsv1alpha1.Settings
 	sn := types.NamespacedName{
@@ -117,138 +248,596 @@ func (r *SettingsReconciler) Reconcile(ctx context.Context, req ctrl.Request) (c
 			ctrl.SetControllerReference(&ab, &s, r.Scheme)
 			if err = r.Create(ctx, &s); err != nil {
 				logger.Error(err, "unable to create settings", "resource", s)
-				return ctrl.Result{}, err
+				return ctrl.Result{}, r.recordReconcileError("settings", err)
 			}
 			logger.V(1).Info("Settings created")
 			return ctrl.Result{Requeue: true}, nil
 		} else {
-			return ctrl.Result{}, err
+			return ctrl.Result{}, r.recordReconcileError("settings", err)
 		}
 	}
 
 	scopy := s.DeepCopy()
+	events := r.newSettingsEvents(ctx, &s, claims)
 
 	if len(s.Status.Conditions) == 0 {
 		patch := client.MergeFrom(scopy)
 		s.Status.Conditions = append(s.Status.Conditions, npCondition)
 		s.Status.Conditions = append(s.Status.Conditions, qtCondition)
+		s.Status.Conditions = append(s.Status.Conditions, lrCondition)
 		err := r.Status().Patch(ctx, &s, patch)
 		if err != nil {
 			logger.Info("Patch error", "error", err)
 		}
-		return ctrl.Result{Requeue: true}, err
+		return ctrl.Result{Requeue: true}, r.recordReconcileError("status", err)
 	}
 
-	var ns corev1.Namespace
-	if err := r.Get(ctx, types.NamespacedName{Name: r.CtrlConfig.Namespace}, &ns); err != nil {
-		if errors.IsNotFound(err) {
-			ns.SetName(r.CtrlConfig.Namespace)
-			// Set the APIBinding instance as the owner and controller
-			ctrl.SetControllerReference(&ab, &ns, r.Scheme)
-			if err = r.Create(ctx, &ns); err != nil {
-				logger.Error(err, "unable to create namespace", "resource", ns)
-				return ctrl.Result{}, err
+	// A new configuration is rolled out according to the rollout strategy. The workspaces, which have not been
+	// selected yet, keep the resources applied with the previous configuration. They are reconciled again
+	// when the canaries become healthy or when the rollout strategy changes.
+	canary, err := isCanary(ctrlConfig.Rollout, &ab)
+	if err != nil {
+		return ctrl.Result{}, r.recordReconcileError("rollout", err)
+	}
+	// The workspaces waiting for the new configuration are still reconciled against the configuration
+	// last applied to them so that drifts get corrected and their status stays up to date.
+	rolloutPending := false
+	if s.Status.ConfigHash != "" && s.Status.ConfigHash != cHash {
+		if reason, message := rolloutBlocked(ctrlConfig.Rollout, r.ExportName, workspace, canary, cHash); reason != "" {
+			logger.V(1).Info("Configuration rollout pending", "reason", reason, "configHash", s.Status.ConfigHash)
+			rolloutCondition.Status = metav1.ConditionFalse
+			rolloutCondition.Reason = reason
+			rolloutCondition.Message = message
+			applied, ok := r.CtrlConfig.Lookup(s.Status.ConfigHash)
+			if !ok {
+				// The configuration last applied is not known anymore, after a restart of the controller
+				// for instance. The workspace is left untouched till it gets the new configuration.
+				err := r.updateConditions(ctx, &s, scopy, claimsCondition, rolloutCondition)
+				workspaces.set(r.ExportName, workspace, s.Status, canary)
+				return ctrl.Result{}, r.recordReconcileError("status", err)
 			}
-			logger.V(1).Info("Settings created")
+			// The quota overrides are not rolled out, the current ones are applied.
+			applied.MaxQuotaOverrides, applied.QuotaOverrides = ctrlConfig.MaxQuotaOverrides, ctrlConfig.QuotaOverrides
+			ctrlConfig, cHash = applied, s.Status.ConfigHash
+			rolloutPending = true
+		}
+	}
+
+	// The inventory of the resources managed in the workspace is bootstrapped from the resources
+	// controlled by the APIBinding when it has not been recorded yet.
+	previous := s.Status.ManagedResources
+	if len(previous) == 0 {
+		var err error
+		if previous, err = r.discoverManagedResources(ctx, &ab, ctrlConfig.Namespace, claims); err != nil {
+			return ctrl.Result{}, r.recordReconcileError("inventory", err)
+		}
+	}
+	inv := newInventory(previous)
+
+	// The namespace is applied only when it gets created, when it is controlled by the APIBinding or when
+	// it gets adopted. A namespace, which has not been created by the controller, is otherwise left untouched
+	// and the workspace is skipped.
+	// Without the namespaces claim the namespace is expected to be created by the workspace owner.
+	if !claims[namespacesClaim] {
+		setClaimNotAcceptedCondition(&nsCondition, namespacesClaim)
+		inv.carry("", "Namespace")
+		// The other resources cannot be applied till the namespace gets created by the workspace owner.
+		if err := r.Get(ctx, types.NamespacedName{Name: ctrlConfig.Namespace}, &corev1.Namespace{}); errors.IsNotFound(err) {
+			message := fmt.Sprintf("Namespace %q does not exist and cannot be created as the %s permission claim has not been accepted", ctrlConfig.Namespace, claimName(namespacesClaim))
+			logger.V(1).Info("Namespace missing without the namespaces claim, skipping the workspace")
+			nsCondition.Message = message
+			for _, condition := range []*metav1.Condition{&npCondition, &qtCondition, &lrCondition} {
+				condition.Status = metav1.ConditionFalse
+				condition.Reason = "NamespaceNotReady"
+				condition.Message = message
+			}
+			// The namespace is not watched, the workspace is checked again later.
+			err := r.updateConditions(ctx, &s, scopy, nsCondition, npCondition, qtCondition, lrCondition, claimsCondition)
+			workspaces.set(r.ExportName, workspace, s.Status, canary)
+			return ctrl.Result{RequeueAfter: NamespaceRequeuePeriod}, r.recordReconcileError("status", err)
+		}
+	} else {
+		var ns corev1.Namespace
+		if err := r.Get(ctx, types.NamespacedName{Name: ctrlConfig.Namespace}, &ns); err != nil && !errors.IsNotFound(err) {
+			return ctrl.Result{}, r.recordReconcileError("namespace", err)
+		}
+		foreign := ns.GetResourceVersion() != "" && !metav1.IsControlledBy(&ns, &ab)
+		// A namespace orphaned by the controller is adopted again whatever the namespace policy.
+		orphaned := ns.GetLabels()[ManagedByLabel] == FieldManager
+		adopt := foreign && (orphaned || ctrlConfig.NamespacePolicy == settingsv1alpha1.NamespacePolicyAdopt) && metav1.GetControllerOf(&ns) == nil
+		if foreign && !adopt {
+			reason, message := namespaceRefusal(&ns)
+			logger.V(1).Info("Namespace not created by the controller, skipping the workspace", "reason", reason)
+			nsCondition.Status = metav1.ConditionFalse
+			nsCondition.Reason = reason
+			nsCondition.Message = message
+			if transitioned(&s, nsCondition) {
+				events.warning(reason, "%s", message)
+			}
+			for _, condition := range []*metav1.Condition{&npCondition, &qtCondition, &lrCondition} {
+				condition.Status = metav1.ConditionFalse
+				condition.Reason = "NamespaceNotReady"
+				condition.Message = message
+			}
+			// The namespace is not watched, the workspace is checked again later.
+			err := r.updateConditions(ctx, &s, scopy, nsCondition, npCondition, qtCondition, lrCondition, claimsCondition)
+			workspaces.set(r.ExportName, workspace, s.Status, canary)
+			return ctrl.Result{RequeueAfter: NamespaceRequeuePeriod}, r.recordReconcileError("status", err)
+		}
+		wsNs := corev1.Namespace{
+			TypeMeta: metav1.TypeMeta{APIVersion: corev1.SchemeGroupVersion.String(), Kind: "Namespace"},
+		}
+		wsNs.SetName(ctrlConfig.Namespace)
+		wsNs.SetLabels(map[string]string{ManagedByLabel: FieldManager})
+		// Set the APIBinding instance as the owner and controller
+		ctrl.SetControllerReference(&ab, &wsNs, r.Scheme)
+		nsHash, err := hash(wsNs.ObjectMeta)
+		if err != nil {
+			return ctrl.Result{}, r.recordReconcileError("namespace", err)
+		}
+		inv.add("", "Namespace", "", ctrlConfig.Namespace)
+		operationResult, err := r.apply(ctx, &ab, &wsNs, &ns)
+		if err != nil {
+			logger.Error(err, "unable to apply namespace", "resource", wsNs)
+			setErrorCondition(&nsCondition, err, fmt.Sprintf("Unable to apply the namespace %q", ctrlConfig.Namespace))
+			if transitioned(&s, nsCondition) {
+				events.warning("NamespaceFailed", "Unable to apply the namespace %q: %v", ctrlConfig.Namespace, err)
+			}
+			for _, condition := range []*metav1.Condition{&npCondition, &qtCondition, &lrCondition} {
+				condition.Status = metav1.ConditionFalse
+				condition.Reason = "NamespaceNotReady"
+				condition.Message = nsCondition.Message
+			}
+			if err := r.updateConditions(ctx, &s, scopy, nsCondition, npCondition, qtCondition, lrCondition, claimsCondition); err != nil {
+				logger.Error(err, "unable to update the Settings status")
+			}
+			workspaces.set(r.ExportName, workspace, s.Status, canary)
+			return ctrl.Result{}, r.recordReconcileError(errorReason("namespace", err), err)
+		}
+		inv.synced("", "Namespace", "", ctrlConfig.Namespace, nsHash, operationResult)
+		if operationResult == cutil.OperationResultCreated {
+			logger.V(1).Info("Namespace created")
+			events.applied("Namespace", ctrlConfig.Namespace, operationResult)
 			return ctrl.Result{Requeue: true}, nil
 		}
-		return ctrl.Result{}, err
+		if adopt {
+			logger.V(1).Info("Namespace adopted")
+			events.applied("Namespace", ctrlConfig.Namespace, operationResult)
+		}
+		nsCondition.Status = metav1.ConditionTrue
+		nsCondition.Reason = "NamespaceOwned"
+		nsCondition.Message = fmt.Sprintf("Namespace %q is managed by the controller", ctrlConfig.Namespace)
+	}
+
+	profile, reason, err := selectProfile(&ctrlConfig, req.ClusterName, &ab, &s)
+	if err != nil {
+		logger.Error(err, "unable to select the settings profile")
+		npCondition.Status = metav1.ConditionFalse
+		npCondition.Reason = reason
+		npCondition.Message = err.Error()
+		qtCondition.Status = metav1.ConditionFalse
+		qtCondition.Reason = reason
+		qtCondition.Message = err.Error()
+		lrCondition.Status = metav1.ConditionFalse
+		lrCondition.Reason = reason
+		lrCondition.Message = err.Error()
+		rolloutCondition.Status = metav1.ConditionFalse
+		rolloutCondition.Reason = reason
+		rolloutCondition.Message = err.Error()
+		if transitioned(&s, qtCondition) {
+			events.warning(reason, "%v", err)
+		}
+		reconcileErrorsTotal.WithLabelValues(r.ExportName, "profile").Inc()
+		// Retrying does not help till the Settings, the APIBinding or the configuration are changed.
+		err := r.updateConditions(ctx, &s, scopy, nsCondition, npCondition, qtCondition, lrCondition, claimsCondition, rolloutCondition)
+		workspaces.set(r.ExportName, workspace, s.Status, canary)
+		return ctrl.Result{}, r.recordReconcileError("status", err)
+	}
+	if profile.Name != "" {
+		logger = logger.WithValues("profile", profile.Name)
+		ctx = ctrl.LoggerInto(ctx, logger)
 	}
 
 	npCondition.Reason = "NetworkPoliciesCreated"
-	npCondition.Message = fmt.Sprintf("NetworkPolicies successfully created in %q namespace", r.CtrlConfig.Namespace)
+	npCondition.Message = fmt.Sprintf("NetworkPolicies successfully created in %q namespace", ctrlConfig.Namespace)
 	npCondition.Status = metav1.ConditionTrue
 
 	qtCondition.Reason = "QuotasCreated"
-	qtCondition.Message = fmt.Sprintf("Quotas successfully created in %q namespace", r.CtrlConfig.Namespace)
+	qtCondition.Message = fmt.Sprintf("Quotas successfully created in %q namespace", ctrlConfig.Namespace)
 	qtCondition.Status = metav1.ConditionTrue
 
+	lrCondition.Reason = "LimitRangesCreated"
+	lrCondition.Message = fmt.Sprintf("LimitRanges successfully created in %q namespace", ctrlConfig.Namespace)
+	lrCondition.Status = metav1.ConditionTrue
+
 	var rtnErr error
+	drifts := driftReport{export: r.ExportName}
 
-	// A single Quota created in a single namespace defined in the operator configuration
-	// The annotation makes the quota cluster scoped.
-	// Reverse claim should enforce that the quota cannot be changed by a workspace admin
-	// as long the workspace is bound to the apiexport of the controller
-	var wsQt corev1.ResourceQuota
-	wsQt.SetNamespace(r.CtrlConfig.Namespace)
-	wsQt.SetName(QtName)
-	wsQt.SetAnnotations(map[string]string{"experimental.quota.kcp.dev/cluster-scoped": "true"})
-	// Set the APIBinding instance as the owner and controller
-	ctrl.SetControllerReference(&ab, &wsQt, r.Scheme)
-	operationResult, rtnErr := cutil.CreateOrPatch(ctx, r.Client, &wsQt, func() error {
-		wsQt.Spec = r.CtrlConfig.QuotaConfig.Spec
-		return nil
-	})
-	if rtnErr != nil {
-		logger.Error(rtnErr, "unable to create or patch the ResourceQuota")
-		qtCondition.Status = metav1.ConditionFalse
-		qtCondition.Reason = "Error"
-		qtCondition.Message = "Unable to create or patch the ResourceQuota"
-	}
-	logger.V(2).Info(string(operationResult), "resource", wsQt)
-
-	// A single NetworkPolicy created in a single namespace defined in the operator configuration
-	// There is no enforcement, more a feature (hermetic build) than a constraint.
-	var wsNP netv1.NetworkPolicy
-	wsNP.SetNamespace(r.CtrlConfig.Namespace)
-	wsNP.SetName(NpName)
-	// Set the APIBinding instance as the owner and controller
-	ctrl.SetControllerReference(&ab, &wsNP, r.Scheme)
-	operationResult, rtnErr = cutil.CreateOrPatch(ctx, r.Client, &wsNP, func() error {
-		wsNP.Spec = r.CtrlConfig.NetPolConfig.Spec
-		return nil
-	})
-	if rtnErr != nil {
-		logger.Error(rtnErr, "unable to create or patch the NetworkPolicy")
-		npCondition.Status = metav1.ConditionFalse
-		npCondition.Reason = "Error"
-		npCondition.Message = "Unable to create or patch the NetworkPolicy"
-	}
-	logger.V(2).Info(string(operationResult), "resource", wsNP)
-
-	// Update the condition only if it is missing, the status or the reason of the available condition has changed.
-	npConditionChanged := true
-	qtConditionChanged := true
-	for i, condition := range s.Status.Conditions {
-		if condition.Type == npCondition.Type {
-			if condition.Status != npCondition.Status || condition.Reason != npCondition.Reason {
-				s.Status.Conditions[i] = npCondition
+	// Quotas created in a single namespace defined in the operator configuration
+	// The overrides configured for the workspace are merged over the quotas of the selected profile.
+	overrides, clamped := quotaOverrides(&ctrlConfig, req.ClusterName)
+	quotas := resourceQuotas(profile.QuotaConfig, overrides)
+	dHash, err := desiredStateHash(ctrlConfig.Namespace, profile, quotas)
+	if err != nil {
+		return ctrl.Result{}, r.recordReconcileError("hash", err)
+	}
+	if len(clamped) > 0 {
+		logger.Info("Quota overrides exceeding the maxima", "overrides", clamped)
+		// The event is only recorded when the desired state changes rather than at each reconciliation.
+		if s.Status.DesiredStateHash != dHash {
+			events.warning("QuotaOverridesClamped", "Quota overrides exceeding the maxima: %s", strings.Join(clamped, ", "))
+		}
+	}
+	s.Status.Quotas = nil
+	if !claims[resourceQuotasClaim] {
+		setClaimNotAcceptedCondition(&qtCondition, resourceQuotasClaim)
+		inv.carry(corev1.GroupName, "ResourceQuota")
+		pressureCondition.Reason = "ClaimNotAccepted"
+		pressureCondition.Message = qtCondition.Message
+	} else if s.Status.Quotas, err = r.reconcileResourceQuotas(ctx, &ab, ctrlConfig.Namespace, quotas, &drifts, events, inv); err != nil {
+		logger.Error(err, "unable to reconcile the ResourceQuotas")
+		setErrorCondition(&qtCondition, err, "Unable to apply or delete the ResourceQuotas")
+		if transitioned(&s, qtCondition) {
+			events.warning("ResourceQuotasFailed", "Unable to apply or delete the ResourceQuotas: %v", err)
+		}
+		rtnErr = r.recordReconcileError(errorReason("resourcequotas", err), err)
+	}
+	if claims[resourceQuotasClaim] {
+		// The on-call is warned before the workspace workloads start being rejected.
+		setQuotaPressureCondition(&pressureCondition, s.Status.Quotas, ctrlConfig.QuotaThresholds)
+		if pressureCondition.Status == metav1.ConditionTrue && transitioned(&s, pressureCondition) {
+			events.warning(pressureCondition.Reason, "%s", pressureCondition.Message)
+		}
+	}
+
+	// NetworkPolicies created in a single namespace defined in the operator configuration
+	if !claims[networkPoliciesClaim] {
+		setClaimNotAcceptedCondition(&npCondition, networkPoliciesClaim)
+		inv.carry(netv1.GroupName, "NetworkPolicy")
+	} else if err := r.reconcileNetworkPolicies(ctx, &ab, ctrlConfig.Namespace, profile.NetPolConfig, &drifts, events, inv); err != nil {
+		logger.Error(err, "unable to reconcile the NetworkPolicies")
+		setErrorCondition(&npCondition, err, "Unable to apply or delete the NetworkPolicies")
+		if transitioned(&s, npCondition) {
+			events.warning("NetworkPoliciesFailed", "Unable to apply or delete the NetworkPolicies: %v", err)
+		}
+		rtnErr = r.recordReconcileError(errorReason("networkpolicies", err), err)
+	}
+
+	// A LimitRange created in the same namespace as the quotas provides default requests and limits
+	// to the containers, which do not specify them.
+	if !claims[limitRangesClaim] {
+		setClaimNotAcceptedCondition(&lrCondition, limitRangesClaim)
+		inv.carry(corev1.GroupName, "LimitRange")
+	} else if err := r.reconcileLimitRange(ctx, &ab, ctrlConfig.Namespace, profile.LimitRangeConfig, &drifts, events, inv); err != nil {
+		logger.Error(err, "unable to reconcile the LimitRange")
+		setErrorCondition(&lrCondition, err, "Unable to apply or delete the LimitRange")
+		if transitioned(&s, lrCondition) {
+			events.warning("LimitRangeFailed", "Unable to apply or delete the LimitRange: %v", err)
+		}
+		rtnErr = r.recordReconcileError(errorReason("limitrange", err), err)
+	} else if len(profile.LimitRangeConfig.Spec.Limits) == 0 {
+		// The LimitRange previously created, if any, gets pruned.
+		lrCondition.Reason = "NotConfigured"
+		lrCondition.Message = "No LimitRange configured"
+	}
+
+	// The resources recorded in the inventory, which are not part of the desired state anymore, are pruned.
+	failed, err := r.pruneStale(ctx, &ab, inv.stale(), events)
+	for _, res := range failed {
+		inv.retain(res)
+	}
+	if err != nil {
+		logger.Error(err, "unable to prune the stale resources")
+		events.warning("PruneFailed", "Unable to prune the resources no longer in the configuration: %v", err)
+		rtnErr = r.recordReconcileError("prune", err)
+	}
+	s.Status.ManagedResources = inv.resources()
+
+	// Changes made to the managed resources outside of the controller are only reported as reverted
+	// when the desired state has been successfully applied again.
+	drifts.count()
+	if corrected := drifts.summary(true); corrected != "" {
+		logger.Info("Drift corrected", "drift", corrected)
+		events.warning("DriftDetected", "Reverted changes to the managed resources: %s", corrected)
+	}
+	switch {
+	case drifts.empty():
+		driftCondition.Status = metav1.ConditionFalse
+		driftCondition.Reason = "NoDrift"
+		driftCondition.Message = "The managed resources match the desired state"
+	case drifts.uncorrected():
+		uncorrected := drifts.summary(false)
+		logger.Info("Drift not corrected", "drift", uncorrected)
+		driftCondition.Status = metav1.ConditionTrue
+		driftCondition.Reason = "DriftNotCorrected"
+		driftCondition.Message = uncorrected
+		if transitioned(&s, driftCondition) {
+			events.warning("DriftNotCorrected", "Unable to revert changes to the managed resources: %s", uncorrected)
+		}
+	default:
+		driftCondition.Status = metav1.ConditionTrue
+		driftCondition.Reason = "DriftCorrected"
+		driftCondition.Message = drifts.summary(true)
+	}
+
+	// The hashes are only updated when the desired state has been applied so that the rollout
+	// of a new configuration can be tracked. The resources, whose claims have not been accepted, are reported
+	// by the conditions.
+	// The reason why the new configuration is pending is kept in the rollout condition.
+	if rtnErr == nil {
+		s.Status.ObservedGeneration = s.Generation
+		s.Status.ConfigHash = cHash
+		s.Status.DesiredStateHash = dHash
+		if !rolloutPending {
+			rolloutCondition.Status = metav1.ConditionTrue
+			rolloutCondition.Reason = "ConfigApplied"
+			rolloutCondition.Message = fmt.Sprintf("The configuration %s has been applied", cHash)
+		}
+	} else if !rolloutPending {
+		rolloutCondition.Status = metav1.ConditionFalse
+		rolloutCondition.Reason = "ApplyFailed"
+		rolloutCondition.Message = fmt.Sprintf("The configuration %s could not be applied", cHash)
+	}
+
+	logger.V(3).Info("Updating the Settings conditions in the current logical cluster")
+	err = r.updateConditions(ctx, &s, scopy, nsCondition, npCondition, qtCondition, lrCondition, driftCondition, claimsCondition, pressureCondition, rolloutCondition)
+	if canary && !rolloutPending {
+		r.trackCanary(cHash, func() { workspaces.set(r.ExportName, workspace, s.Status, canary) })
+	} else {
+		workspaces.set(r.ExportName, workspace, s.Status, canary)
+	}
+	if err != nil {
+		logger.Info("Patch error", "error", err)
+		// TODO: depending on the error it may be better to just give up
+		if rtnErr == nil {
+			return ctrl.Result{}, r.recordReconcileError("status", err)
+		}
+	}
+	return ctrl.Result{}, rtnErr
+}
+
+// trackCanary records the state of a canary workspace through update. The workspaces waiting for the canaries
+// are not requeued periodically: OnCanariesHealthy is called when the update makes the canaries healthy
+// with the configuration. The changes of the rollout strategy trigger the reconciliation of all the workspaces.
+func (r *SettingsReconciler) trackCanary(configHash string, update func()) {
+	healthy := workspaces.canariesHealthy(r.ExportName, configHash)
+	update()
+	if !healthy && workspaces.canariesHealthy(r.ExportName, configHash) && r.OnCanariesHealthy != nil {
+		ctrl.Log.WithName("settings-reconciler").V(1).Info("Canary workspaces healthy with the new configuration", "configHash", configHash)
+		r.OnCanariesHealthy()
+	}
+}
+
+// setErrorCondition sets the condition to False. A dedicated reason is used when the error results
+// from fields managed by another writer, which the controller does not override.
+func setErrorCondition(condition *metav1.Condition, err error, message string) {
+	condition.Status = metav1.ConditionFalse
+	if isConflict(err) {
+		condition.Reason = "ApplyConflict"
+		condition.Message = fmt.Sprintf("%s, conflict with another field manager: %v", message, err)
+		return
+	}
+	condition.Reason = "Error"
+	condition.Message = message
+}
+
+// transitioned returns whether the condition differs, in status or reason, from the one recorded in the Settings.
+// The warnings about a lasting failure are only recorded on the transition rather than at each retry.
+func transitioned(s *settingsv1alpha1.Settings, condition metav1.Condition) bool {
+	previous := meta.FindStatusCondition(s.Status.Conditions, condition.Type)
+	return previous == nil || previous.Status != condition.Status || previous.Reason != condition.Reason
+}
+
+// errorReason returns the reason of a reconcile error for the metrics.
+// Conflicts with other field managers are distinguished from other failures.
+func errorReason(resource string, err error) string {
+	if isConflict(err) {
+		return "apply_conflict"
+	}
+	return resource
+}
+
+// setClaimNotAcceptedCondition sets the condition to False as the resources cannot be managed
+// without the permission claim being accepted.
+func setClaimNotAcceptedCondition(condition *metav1.Condition, claim apisv1alpha1.GroupResource) {
+	condition.Status = metav1.ConditionFalse
+	condition.Reason = "ClaimNotAccepted"
+	condition.Message = fmt.Sprintf("The %s permission claim has not been accepted", claimName(claim))
+}
+
+// namespaceRefusal returns the reason and the message explaining why a namespace, which has not been created
+// by the controller, is not adopted.
+func namespaceRefusal(ns *corev1.Namespace) (string, string) {
+	if owner := metav1.GetControllerOf(ns); owner != nil {
+		return "NamespaceControlledByOther", fmt.Sprintf("Namespace %q is controlled by %s %q", ns.Name, owner.Kind, owner.Name)
+	}
+	return "NamespaceNotOwned", fmt.Sprintf("Namespace %q already exists and has not been created by the controller, the namespace policy does not allow adopting it", ns.Name)
+}
+
+// selectProfile returns the settings profile selected for the workspace. The profile named in the Settings
+// takes precedence over the one named in the APIBinding annotation. The default configuration
+// is returned, as a profile without name, when none of them specifies a profile.
+// The sections not set in the profile are inherited from the default configuration.
+// The reason of the failure is returned with the error when the profile is not defined or not allowed in the workspace.
+func selectProfile(ctrlConfig *settingsv1alpha1.SettingsConfig, workspace string, ab *apisv1alpha1.APIBinding, s *settingsv1alpha1.Settings) (settingsv1alpha1.SettingsProfile, string, error) {
+	name := s.Spec.Profile
+	if name == "" {
+		name = ab.GetAnnotations()[ProfileAnnotation]
+	}
+	if name == "" {
+		return settingsv1alpha1.SettingsProfile{
+			NetPolConfig:     ctrlConfig.NetPolConfig,
+			QuotaConfig:      ctrlConfig.QuotaConfig,
+			LimitRangeConfig: ctrlConfig.LimitRangeConfig,
+		}, "", nil
+	}
+	if allowed, restricted := allowedProfiles(ctrlConfig, workspace); restricted && !contains(allowed, name) {
+		return settingsv1alpha1.SettingsProfile{}, "ProfileNotAllowed", fmt.Errorf("profile %q is not allowed in the workspace", name)
+	}
+	for _, profile := range ctrlConfig.Profiles {
+		if profile.Name != name {
+			continue
+		}
+		if unset(profile.NetPolConfig) {
+			profile.NetPolConfig = ctrlConfig.NetPolConfig
+		}
+		if unset(profile.QuotaConfig) {
+			profile.QuotaConfig = ctrlConfig.QuotaConfig
+		}
+		if unset(profile.LimitRangeConfig) {
+			profile.LimitRangeConfig = ctrlConfig.LimitRangeConfig
+		}
+		return profile, "", nil
+	}
+	return settingsv1alpha1.SettingsProfile{}, "ProfileNotFound", fmt.Errorf("profile %q is not defined in the controller configuration", name)
+}
+
+// allowedProfiles returns the names of the profiles, which can be selected in the workspace,
+// and false when the selection is not restricted in the workspace.
+func allowedProfiles(ctrlConfig *settingsv1alpha1.SettingsConfig, workspace string) ([]string, bool) {
+	for _, allowed := range ctrlConfig.AllowedProfiles {
+		if allowed.Workspace == workspace {
+			return allowed.Profiles, true
+		}
+	}
+	return nil, false
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// unset returns true if the section of a profile has not been specified.
+func unset(section interface{}) bool {
+	return reflect.ValueOf(section).IsZero()
+}
+
+// desiredStateHash returns the hash of the effective desired state of the workspace:
+// the namespace and the configuration of the selected profile, with the quota overrides merged.
+func desiredStateHash(namespace string, profile settingsv1alpha1.SettingsProfile, quotas []settingsv1alpha1.NamedResourceQuota) (string, error) {
+	return hash(struct {
+		Namespace        string
+		NetPolConfig     settingsv1alpha1.SettingsNetPolConfig
+		Quotas           []settingsv1alpha1.NamedResourceQuota
+		LimitRangeConfig settingsv1alpha1.SettingsLimitRangeConfig
+	}{namespace, profile.NetPolConfig, quotas, profile.LimitRangeConfig})
+}
+
+// updateConditions patches the Settings status with the provided conditions and the other fields of the status,
+// which have been set on the Settings. A condition is only updated if it is missing, or if its status,
+// its reason or its message has changed. The last transition time is kept when the status has not changed.
+func (r *SettingsReconciler) updateConditions(ctx context.Context, s *settingsv1alpha1.Settings, scopy *settingsv1alpha1.Settings, conditions ...metav1.Condition) error {
+	changed := !equality.Semantic.DeepEqual(s.Status, scopy.Status)
+	for _, condition := range conditions {
+		found := false
+		for i, existing := range s.Status.Conditions {
+			if existing.Type != condition.Type {
 				continue
-			} else {
-				npConditionChanged = false
 			}
-		}
-		if condition.Type == qtCondition.Type {
-			if condition.Status != qtCondition.Status || condition.Reason != qtCondition.Reason {
-				s.Status.Conditions[i] = qtCondition
-			} else {
-				qtConditionChanged = false
+			found = true
+			if existing.Status != condition.Status {
+				s.Status.Conditions[i] = condition
+				changed = true
+			} else if existing.Reason != condition.Reason || existing.Message != condition.Message {
+				s.Status.Conditions[i].Reason = condition.Reason
+				s.Status.Conditions[i].Message = condition.Message
+				changed = true
 			}
+			break
+		}
+		if !found {
+			s.Status.Conditions = append(s.Status.Conditions, condition)
+			changed = true
 		}
 	}
 
-	if npConditionChanged || qtConditionChanged {
-		logger.V(3).Info("Patching Settings status to store the new condition(s) in the current logical cluster")
-		patch := client.MergeFrom(scopy)
+	if !changed {
+		return nil
+	}
+	return r.Status().Patch(ctx, s, client.MergeFrom(scopy))
+}
 
-		if err := r.Status().Patch(ctx, &s, patch); err != nil {
-			logger.Info("Patch error", "error", err)
-			// TODO: depending on the error it may be better to just give up
-			if rtnErr == nil {
-				return ctrl.Result{}, err
+// EnqueueAll triggers the reconciliation of all the APIBindings visible to the controller.
+// It is used to roll out a new configuration to all workspaces.
+func (r *SettingsReconciler) EnqueueAll(ctx context.Context) error {
+	var abs apisv1alpha1.APIBindingList
+	if err := r.List(ctx, &abs, client.MatchingFields{APIBindingExportIndex: r.ExportIdentityHash}); err != nil {
+		return fmt.Errorf("error listing APIBindings: %w", err)
+	}
+	for i := range abs.Items {
+		select {
+		case r.configEvents <- event.GenericEvent{Object: &abs.Items[i]}:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	ctrl.Log.WithName("settings-reconciler").V(1).Info("APIBindings enqueued after a configuration change", "count", len(abs.Items))
+	return nil
+}
+
+// boundIdentities returns the identities of the APIExports whose resources are bound by the APIBinding.
+func boundIdentities(ab *apisv1alpha1.APIBinding) []string {
+	var identities []string
+	seen := map[string]bool{}
+	for _, resource := range ab.Status.BoundResources {
+		if identity := resource.Schema.IdentityHash; identity != "" && !seen[identity] {
+			seen[identity] = true
+			identities = append(identities, identity)
+		}
+	}
+	return identities
+}
+
+// bindsExport returns whether the APIBinding binds the resources of the APIExport of the controller.
+// Only these APIBindings are reconciled. The other ones are filtered out before entering the work queue.
+// An APIBinding, which has not been bound yet, passes the filter when its status gets updated.
+func (r *SettingsReconciler) bindsExport(obj client.Object) bool {
+	if ab, ok := obj.(*apisv1alpha1.APIBinding); ok {
+		for _, identity := range boundIdentities(ab) {
+			if identity == r.ExportIdentityHash {
+				return true
 			}
 		}
 	}
+	apiBindingsFilteredTotal.WithLabelValues(r.ExportName).Inc()
+	return false
+}
 
-	return ctrl.Result{}, rtnErr
+// indexAPIBindingExport is the index function of the APIBindingExportIndex.
+func indexAPIBindingExport(obj client.Object) []string {
+	return boundIdentities(obj.(*apisv1alpha1.APIBinding))
 }
 
 // SetupWithManager sets up the controller with the Manager.
 func (r *SettingsReconciler) SetupWithManager(mgr ctrl.Manager) error {
+	r.configEvents = make(chan event.GenericEvent)
+	if err := mgr.GetFieldIndexer().IndexField(context.Background(), &apisv1alpha1.APIBinding{}, APIBindingExportIndex, indexAPIBindingExport); err != nil {
+		return err
+	}
+	// The controllers of the different APIExports are told apart in the controller-runtime metrics and logs.
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&apisv1alpha1.APIBinding{}).
+		Named(controllerName(r.ExportName)).
+		For(&apisv1alpha1.APIBinding{}, builder.WithPredicates(predicate.NewPredicateFuncs(r.bindsExport))).
 		Owns(&settingsv1alpha1.Settings{}).
 		Owns(&corev1.ResourceQuota{}).
 		Owns(&netv1.NetworkPolicy{}).
+		Owns(&corev1.LimitRange{}).
+		Watches(&source.Channel{Source: r.configEvents}, &handler.EnqueueRequestForObject{}).
 		Complete(r)
 }
+
+// controllerName returns the name of the controller reconciling the APIBindings of the APIExport.
+// The name is used as a metric label: the characters other than alphanumeric ones are replaced with underscores.
+func controllerName(export string) string {
+	return "apibinding_" + strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') {
+			return r
+		}
+		return '_'
+	}, export)
+}
@@ -0,0 +1,159 @@
+package controllers
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+func TestSelectProfile(t *testing.T) {
+	config := validConfig()
+	config.QuotaConfig = settingsv1alpha1.SettingsQuotaConfig{Spec: corev1.ResourceQuotaSpec{Hard: resourceList("pods", "10")}}
+	config.LimitRangeConfig.Spec.Limits = []corev1.LimitRangeItem{{Type: corev1.LimitTypeContainer, DefaultRequest: resourceList("cpu", "100m")}}
+	isolated := settingsv1alpha1.SettingsNetPolConfig{Policies: []settingsv1alpha1.NamedNetworkPolicy{{Name: "isolated", Spec: config.NetPolConfig.Spec}}}
+	config.Profiles = []settingsv1alpha1.SettingsProfile{
+		{Name: "small", QuotaConfig: settingsv1alpha1.SettingsQuotaConfig{Spec: corev1.ResourceQuotaSpec{Hard: resourceList("pods", "5")}}},
+		{Name: "enterprise", QuotaConfig: settingsv1alpha1.SettingsQuotaConfig{Spec: corev1.ResourceQuotaSpec{Hard: resourceList("pods", "100")}}},
+		{Name: "isolated", NetPolConfig: isolated},
+	}
+	config.AllowedProfiles = []settingsv1alpha1.SettingsAllowedProfiles{{Workspace: "root:org:free", Profiles: []string{"small"}}}
+	tests := []struct {
+		name       string
+		workspace  string
+		settings   string
+		annotation string
+		profile    string
+		pods       string
+		reason     string
+	}{
+		{name: "default configuration", pods: "10"},
+		{name: "selected in the Settings", settings: "small", profile: "small", pods: "5"},
+		{name: "selected in the APIBinding", annotation: "enterprise", profile: "enterprise", pods: "100"},
+		{name: "Settings taking precedence", settings: "small", annotation: "enterprise", profile: "small", pods: "5"},
+		// The quotas are inherited from the default configuration.
+		{name: "profile without quotas", settings: "isolated", profile: "isolated", pods: "10"},
+		{name: "undefined profile", settings: "large", reason: "ProfileNotFound"},
+		{name: "allowed profile", workspace: "root:org:free", settings: "small", profile: "small", pods: "5"},
+		{name: "profile not allowed in the Settings", workspace: "root:org:free", settings: "enterprise", reason: "ProfileNotAllowed"},
+		{name: "profile not allowed in the APIBinding", workspace: "root:org:free", annotation: "enterprise", reason: "ProfileNotAllowed"},
+		// The default configuration can always be used.
+		{name: "default configuration in a restricted workspace", workspace: "root:org:free", pods: "10"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ab := &apisv1alpha1.APIBinding{}
+			if tt.annotation != "" {
+				ab.SetAnnotations(map[string]string{ProfileAnnotation: tt.annotation})
+			}
+			s := &settingsv1alpha1.Settings{Spec: settingsv1alpha1.SettingsSpec{Profile: tt.settings}}
+			profile, reason, err := selectProfile(&config, tt.workspace, ab, s)
+			if (err != nil) != (tt.reason != "") || reason != tt.reason {
+				t.Fatalf("selectProfile() error = %v with reason %q, expected reason %q", err, reason, tt.reason)
+			}
+			if tt.reason != "" {
+				return
+			}
+			if profile.Name != tt.profile {
+				t.Errorf("selectProfile() = %q, expected %q", profile.Name, tt.profile)
+			}
+			if pods := profile.QuotaConfig.Spec.Hard["pods"]; pods.String() != tt.pods {
+				t.Errorf("selectProfile() has %s pods, expected %s", pods.String(), tt.pods)
+			}
+			// The sections not set in the profile are inherited from the default configuration.
+			netPolConfig := config.NetPolConfig
+			if tt.profile == "isolated" {
+				netPolConfig = isolated
+			}
+			if !equality.Semantic.DeepEqual(profile.NetPolConfig, netPolConfig) {
+				t.Errorf("selectProfile() network policies = %+v, expected %+v", profile.NetPolConfig, netPolConfig)
+			}
+			if !equality.Semantic.DeepEqual(profile.LimitRangeConfig, config.LimitRangeConfig) {
+				t.Errorf("selectProfile() limit range = %+v, expected %+v", profile.LimitRangeConfig, config.LimitRangeConfig)
+			}
+		})
+	}
+}
+
+func TestControllerName(t *testing.T) {
+	for export, expected := range map[string]string{
+		"settings-configuration.pipeline-service.io": "apibinding_settings_configuration_pipeline_service_io",
+		"staging": "apibinding_staging",
+		"Prod2":   "apibinding_Prod2",
+	} {
+		if name := controllerName(export); name != expected {
+			t.Errorf("controllerName(%q) = %q, expected %q", export, name, expected)
+		}
+	}
+}
+
+func TestBindsExport(t *testing.T) {
+	r := &SettingsReconciler{ExportName: testExportName, ExportIdentityHash: testExportIdentity}
+	tests := []struct {
+		name       string
+		identities []string
+		binds      bool
+		indexed    []string
+	}{
+		{name: "controller export", identities: []string{testExportIdentity, testExportIdentity}, binds: true, indexed: []string{testExportIdentity}},
+		{name: "other export", identities: []string{"other-identity"}, indexed: []string{"other-identity"}},
+		{name: "several exports", identities: []string{"other-identity", testExportIdentity}, binds: true, indexed: []string{"other-identity", testExportIdentity}},
+		{name: "not bound yet"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ab := &apisv1alpha1.APIBinding{Status: apisv1alpha1.APIBindingStatus{BoundResources: boundResources(tt.identities...)}}
+			filtered := testutil.ToFloat64(apiBindingsFilteredTotal.WithLabelValues(testExportName))
+			if binds := r.bindsExport(ab); binds != tt.binds {
+				t.Errorf("bindsExport() = %t, expected %t", binds, tt.binds)
+			}
+			// The events of the APIBindings to other exports are counted when filtered out.
+			expected := 1.0
+			if tt.binds {
+				expected = 0
+			}
+			if counted := testutil.ToFloat64(apiBindingsFilteredTotal.WithLabelValues(testExportName)) - filtered; counted != expected {
+				t.Errorf("%v filtered APIBindings counted, expected %v", counted, expected)
+			}
+			if indexed := indexAPIBindingExport(ab); !reflect.DeepEqual(indexed, tt.indexed) {
+				t.Errorf("APIBinding indexed with %v, expected %v", indexed, tt.indexed)
+			}
+		})
+	}
+}
+
+func TestEnqueueAll(t *testing.T) {
+	binding := func(name string, identities ...string) *apisv1alpha1.APIBinding {
+		ab := newTestAPIBinding()
+		ab.Name = name
+		ab.Status.BoundResources = boundResources(identities...)
+		return ab
+	}
+	r := newTestReconciler(t, nil,
+		binding("settings", testExportIdentity),
+		binding("other", "other-identity"),
+		binding("more", "other-identity", testExportIdentity),
+		binding("unbound"),
+	)
+	r.ExportIdentityHash = testExportIdentity
+	r.configEvents = make(chan event.GenericEvent, 10)
+
+	if err := r.EnqueueAll(context.Background()); err != nil {
+		t.Fatalf("EnqueueAll() failed: %v", err)
+	}
+	close(r.configEvents)
+	var enqueued []string
+	for e := range r.configEvents {
+		enqueued = append(enqueued, e.Object.GetName())
+	}
+	if expected := []string{"more", "settings"}; !sameElements(enqueued, expected) {
+		t.Errorf("enqueued APIBindings %v, expected %v", enqueued, expected)
+	}
+}
@@ -0,0 +1,57 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/kcp-dev/logicalcluster/v2"
+	"k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/runtime"
+	ctrl "sigs.k8s.io/controller-runtime"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+// SettingsValidator validates the Settings of the workspaces against the current controller configuration.
+// It implements admission.CustomValidator.
+type SettingsValidator struct {
+	CtrlConfig *ConfigStore
+}
+
+//+kubebuilder:webhook:path=/validate-configuration-pipeline-service-io-v1alpha1-settings,mutating=false,failurePolicy=fail,sideEffects=None,groups=configuration.pipeline-service.io,resources=settings,verbs=create;update,versions=v1alpha1,name=vsettings.kb.io,admissionReviewVersions=v1
+
+// SetupWebhookWithManager registers the validating webhook for Settings with the manager.
+func (v *SettingsValidator) SetupWebhookWithManager(mgr ctrl.Manager) error {
+	return ctrl.NewWebhookManagedBy(mgr).
+		For(&settingsv1alpha1.Settings{}).
+		WithValidator(v).
+		Complete()
+}
+
+// ValidateCreate implements admission.CustomValidator.
+func (v *SettingsValidator) ValidateCreate(ctx context.Context, obj runtime.Object) error {
+	return v.validate(obj)
+}
+
+// ValidateUpdate implements admission.CustomValidator.
+func (v *SettingsValidator) ValidateUpdate(ctx context.Context, oldObj, newObj runtime.Object) error {
+	return v.validate(newObj)
+}
+
+// ValidateDelete implements admission.CustomValidator. Deletions are always allowed.
+func (v *SettingsValidator) ValidateDelete(ctx context.Context, obj runtime.Object) error {
+	return nil
+}
+
+func (v *SettingsValidator) validate(obj runtime.Object) error {
+	s, ok := obj.(*settingsv1alpha1.Settings)
+	if !ok {
+		return fmt.Errorf("expected a Settings but got a %T", obj)
+	}
+	ctrlConfig := v.CtrlConfig.Get()
+	// The logical cluster of the Settings identifies the workspace.
+	if errs := validateSettings(&ctrlConfig, logicalcluster.From(s).String(), s); len(errs) > 0 {
+		return errors.NewInvalid(settingsv1alpha1.GroupVersion.WithKind("Settings").GroupKind(), s.Name, errs)
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	kerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/rest"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/kcp"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// ShardManager runs the settings controller against each virtual workspace URL of the APIExport,
+// one per shard, with its own cluster-aware cache. It keeps the running controllers in sync with
+// the URLs published in the APIExport status so that the APIBindings of all shards get reconciled.
+// It implements manager.Runnable.
+type ShardManager struct {
+	// Client used to read the APIExport
+	Client client.Reader
+	// ExportName is the name of the APIExport
+	ExportName string
+	// RestConfig is the configuration used for the virtual workspaces, the host is replaced by their URLs
+	RestConfig *rest.Config
+	// Scheme of the shard managers
+	Scheme *runtime.Scheme
+	// NewReconciler returns a reconciler using the client of the shard manager passed as parameter
+	NewReconciler func(mgr ctrl.Manager) *SettingsReconciler
+	// Interval between two checks of the virtual workspace URLs
+	Interval time.Duration
+
+	// newShard creates and starts the shard of a virtual workspace URL, startShard if not set
+	newShard func(ctx context.Context, url string) (*shard, error)
+
+	lock   sync.Mutex
+	shards map[string]*shard
+	// enqueueRequests holds a pending request for enqueuing the APIBindings of all shards
+	enqueueRequests chan struct{}
+}
+
+// shard is a manager running the settings controller against a virtual workspace URL.
+type shard struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan struct{}
+	reconciler *SettingsReconciler
+}
+
+// Start implements manager.Runnable. It blocks till the context is cancelled and stops the shard managers then.
+func (m *ShardManager) Start(ctx context.Context) error {
+	m.lock.Lock()
+	m.shards = map[string]*shard{}
+	m.enqueueRequests = make(chan struct{}, 1)
+	m.lock.Unlock()
+
+	// The reconcilers request the APIBindings of all shards to be enqueued when the canaries of a rollout
+	// become healthy. The requests are served outside of the reconciliations.
+	go func() {
+		for {
+			select {
+			case <-m.enqueueRequests:
+				if err := m.EnqueueAll(ctx); err != nil {
+					ctrl.Log.WithName("shard-manager").Error(err, "unable to enqueue APIBindings", "api-export-name", m.ExportName)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	wait.UntilWithContext(ctx, m.sync, m.Interval)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for url, s := range m.shards {
+		s.cancel()
+		<-s.done
+		delete(m.shards, url)
+	}
+	return nil
+}
+
+// sync starts a manager for each new virtual workspace URL of the APIExport
+// and stops the managers of the URLs, which are not published anymore.
+func (m *ShardManager) sync(ctx context.Context) {
+	logger := ctrl.Log.WithName("shard-manager").WithValues("api-export-name", m.ExportName)
+
+	var apiExport apisv1alpha1.APIExport
+	if err := m.Client.Get(ctx, types.NamespacedName{Name: m.ExportName}, &apiExport); err != nil {
+		logger.Error(err, "unable to get the APIExport")
+		return
+	}
+	urls := map[string]bool{}
+	for _, vw := range apiExport.Status.VirtualWorkspaces {
+		urls[vw.URL] = true
+	}
+	if len(urls) == 0 {
+		logger.Info("APIExport status.virtualWorkspaces is empty")
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	for url, s := range m.shards {
+		select {
+		case <-s.done:
+			// The manager has stopped on error, it gets restarted.
+			logger.Info("Manager for virtual workspace stopped", "url", url)
+			delete(m.shards, url)
+			continue
+		default:
+		}
+		if !urls[url] {
+			logger.Info("Stopping manager for removed virtual workspace", "url", url)
+			s.cancel()
+			<-s.done
+			delete(m.shards, url)
+		}
+	}
+
+	for url := range urls {
+		if _, ok := m.shards[url]; ok {
+			continue
+		}
+		newShard := m.newShard
+		if newShard == nil {
+			newShard = m.startShard
+		}
+		s, err := newShard(ctx, url)
+		if err != nil {
+			logger.Error(err, "unable to start manager for virtual workspace", "url", url)
+			continue
+		}
+		logger.Info("Started manager for virtual workspace", "url", url)
+		m.shards[url] = s
+	}
+}
+
+// startShard creates and starts a cluster-aware manager running the settings controller against the URL.
+func (m *ShardManager) startShard(ctx context.Context, url string) (*shard, error) {
+	cfg := rest.CopyConfig(m.RestConfig)
+	cfg.Host = url
+
+	// Metrics, health probes and leader election are handled by the main manager.
+	mgr, err := kcp.NewClusterAwareManager(cfg, ctrl.Options{
+		Scheme:             m.Scheme,
+		MetricsBindAddress: "0",
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to create cluster aware manager: %w", err)
+	}
+	reconciler := m.NewReconciler(mgr)
+	reconciler.OnCanariesHealthy = m.requestEnqueueAll
+	if err := reconciler.SetupWithManager(mgr); err != nil {
+		return nil, fmt.Errorf("unable to create controller: %w", err)
+	}
+
+	return runShard(ctx, url, reconciler, mgr.Start), nil
+}
+
+// runShard runs the start function of the shard manager in the background till the context is cancelled.
+// The context of the shard is cancelled as well when the manager stops on error.
+func runShard(ctx context.Context, url string, reconciler *SettingsReconciler, start func(context.Context) error) *shard {
+	s := &shard{
+		done:       make(chan struct{}),
+		reconciler: reconciler,
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(s.done)
+		if err := start(s.ctx); err != nil {
+			ctrl.Log.WithName("shard-manager").Error(err, "problem running manager", "url", url)
+			s.cancel()
+		}
+	}()
+	return s
+}
+
+// requestEnqueueAll requests the APIBindings of all shards to be enqueued without blocking.
+// The requests made while one is pending are merged into it.
+func (m *ShardManager) requestEnqueueAll() {
+	select {
+	case m.enqueueRequests <- struct{}{}:
+	default:
+	}
+}
+
+// EnqueueAll triggers the reconciliation of all the APIBindings of all shards.
+// The shards are enqueued one after the other without holding the lock: a shard controller may
+// still be starting and sync needs the lock for stopping the shards, which cancels their enqueuing.
+func (m *ShardManager) EnqueueAll(ctx context.Context) error {
+	m.lock.Lock()
+	shards := make(map[string]*shard, len(m.shards))
+	for url, s := range m.shards {
+		shards[url] = s
+	}
+	m.lock.Unlock()
+
+	var errs []error
+	for url, s := range shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		// A shard stopped in the meantime has no APIBindings to enqueue.
+		if err := s.reconciler.EnqueueAll(s.ctx); err != nil && s.ctx.Err() == nil {
+			errs = append(errs, fmt.Errorf("unable to enqueue APIBindings of %s: %w", url, err))
+		}
+	}
+	return kerrors.NewAggregate(errs)
+}
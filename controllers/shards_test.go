@@ -0,0 +1,141 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+
+	apisv1alpha1 "github.com/kcp-dev/kcp/pkg/apis/apis/v1alpha1"
+)
+
+// shardURLs returns the URLs of the shards run by the manager.
+func shardURLs(m *ShardManager) []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var urls []string
+	for url := range m.shards {
+		urls = append(urls, url)
+	}
+	return urls
+}
+
+func TestShardManagerSync(t *testing.T) {
+	export := &apisv1alpha1.APIExport{ObjectMeta: metav1.ObjectMeta{Name: testExportName}}
+	setURLs := func(c client.Client, urls ...string) {
+		export.Status.VirtualWorkspaces = nil
+		for _, url := range urls {
+			export.Status.VirtualWorkspaces = append(export.Status.VirtualWorkspaces, apisv1alpha1.VirtualWorkspace{URL: url})
+		}
+		if c != nil {
+			if err := c.Status().Update(context.Background(), export); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	setURLs(nil, "https://shard-1", "https://shard-2")
+	c := fake.NewClientBuilder().WithScheme(newTestScheme(t)).WithObjects(export).Build()
+
+	// The shard managers run till their context is cancelled or fail right away.
+	started := map[string]int{}
+	failing := map[string]bool{}
+	m := &ShardManager{Client: c, ExportName: testExportName, shards: map[string]*shard{}}
+	m.newShard = func(ctx context.Context, url string) (*shard, error) {
+		started[url]++
+		fail := failing[url]
+		return runShard(ctx, url, nil, func(ctx context.Context) error {
+			if fail {
+				return errors.New("unable to start")
+			}
+			<-ctx.Done()
+			return nil
+		}), nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer func() {
+		cancel()
+		for _, s := range m.shards {
+			<-s.done
+		}
+	}()
+
+	m.sync(ctx)
+	if urls, expected := shardURLs(m), []string{"https://shard-1", "https://shard-2"}; !sameElements(urls, expected) {
+		t.Fatalf("shards %v, expected %v", urls, expected)
+	}
+	removed, kept := m.shards["https://shard-1"], m.shards["https://shard-2"]
+
+	// A URL is removed and another one added.
+	setURLs(c, "https://shard-2", "https://shard-3")
+	failing["https://shard-3"] = true
+	m.sync(ctx)
+	if urls, expected := shardURLs(m), []string{"https://shard-2", "https://shard-3"}; !sameElements(urls, expected) {
+		t.Fatalf("shards %v, expected %v", urls, expected)
+	}
+	select {
+	case <-removed.done:
+	default:
+		t.Errorf("the shard of the removed URL has not been stopped")
+	}
+	if m.shards["https://shard-2"] != kept || started["https://shard-2"] != 1 {
+		t.Errorf("the shard of the kept URL has been restarted")
+	}
+
+	// The context of a shard stopped on error is cancelled and the shard gets restarted.
+	failed := m.shards["https://shard-3"]
+	<-failed.done
+	if failed.ctx.Err() == nil {
+		t.Errorf("the context of the failed shard has not been cancelled")
+	}
+	failing["https://shard-3"] = false
+	m.sync(ctx)
+	if s := m.shards["https://shard-3"]; s == nil || s == failed || started["https://shard-3"] != 2 {
+		t.Errorf("the failed shard has not been restarted")
+	}
+
+	// All the shards are stopped when the URLs are not published anymore.
+	setURLs(c)
+	m.sync(ctx)
+	if urls := shardURLs(m); len(urls) != 0 {
+		t.Errorf("shards %v, expected none", urls)
+	}
+	if kept.ctx.Err() == nil {
+		t.Errorf("the shard has not been stopped")
+	}
+}
+
+func TestShardManagerEnqueueAll(t *testing.T) {
+	newShard := func(ctx context.Context, events chan event.GenericEvent) *shard {
+		r := newTestReconciler(t, nil, newTestAPIBinding())
+		r.ExportIdentityHash = testExportIdentity
+		r.configEvents = events
+		s := &shard{done: make(chan struct{}), reconciler: r}
+		s.ctx, s.cancel = context.WithCancel(ctx)
+		return s
+	}
+	ctx := context.Background()
+	running := make(chan event.GenericEvent, 10)
+	// The controller of the stopped shard does not receive the events anymore.
+	stopped := newShard(ctx, make(chan event.GenericEvent))
+	stopped.cancel()
+	m := &ShardManager{shards: map[string]*shard{
+		"https://shard-1": newShard(ctx, running),
+		"https://shard-2": stopped,
+	}}
+
+	if err := m.EnqueueAll(ctx); err != nil {
+		t.Fatalf("EnqueueAll() failed: %v", err)
+	}
+	close(running)
+	var enqueued []string
+	for e := range running {
+		enqueued = append(enqueued, e.Object.GetName())
+	}
+	if expected := []string{"settings"}; !sameElements(enqueued, expected) {
+		t.Errorf("enqueued APIBindings %v, expected %v", enqueued, expected)
+	}
+}
@@ -0,0 +1,299 @@
+package controllers
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	netv1 "k8s.io/api/networking/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+// ValidateConfig returns the errors found in the settings configuration.
+// An invalid configuration is rejected rather than partially rolled out to the workspaces.
+func ValidateConfig(config *settingsv1alpha1.SettingsConfig) field.ErrorList {
+	var errs field.ErrorList
+
+	nsPath := field.NewPath("namespace")
+	if config.Namespace == "" {
+		errs = append(errs, field.Required(nsPath, "the namespace of the managed resources is required"))
+	} else {
+		for _, msg := range validation.IsDNS1123Label(config.Namespace) {
+			errs = append(errs, field.Invalid(nsPath, config.Namespace, msg))
+		}
+	}
+
+	switch config.CleanupPolicy {
+	case "", settingsv1alpha1.CleanupPolicyDelete, settingsv1alpha1.CleanupPolicyOrphan:
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("cleanupPolicy"), config.CleanupPolicy,
+			[]string{string(settingsv1alpha1.CleanupPolicyDelete), string(settingsv1alpha1.CleanupPolicyOrphan)}))
+	}
+
+	switch config.NamespacePolicy {
+	case "", settingsv1alpha1.NamespacePolicyAdopt, settingsv1alpha1.NamespacePolicyRefuse:
+	default:
+		errs = append(errs, field.NotSupported(field.NewPath("namespacePolicy"), config.NamespacePolicy,
+			[]string{string(settingsv1alpha1.NamespacePolicyAdopt), string(settingsv1alpha1.NamespacePolicyRefuse)}))
+	}
+
+	errs = append(errs, validateNetPolConfig(config.NetPolConfig, field.NewPath("networkPolicyConfig"))...)
+	errs = append(errs, validateQuotaConfig(config.QuotaConfig, field.NewPath("quotaConfig"))...)
+	errs = append(errs, validateLimitRangeConfig(config.LimitRangeConfig, field.NewPath("limitRangeConfig"))...)
+	errs = append(errs, validateAllowedProfiles(config, field.NewPath("allowedProfiles"))...)
+	errs = append(errs, validateResourceList(config.MaxQuotaOverrides, field.NewPath("maxQuotaOverrides"))...)
+	errs = append(errs, validateQuotaOverrides(config, field.NewPath("quotaOverrides"))...)
+	errs = append(errs, validateQuotaThresholds(config.QuotaThresholds, field.NewPath("quotaThresholds"))...)
+	errs = append(errs, validateRollout(config.Rollout, field.NewPath("rollout"))...)
+
+	names := map[string]bool{}
+	for i, profile := range config.Profiles {
+		path := field.NewPath("profiles").Index(i)
+		for _, msg := range validation.IsDNS1123Label(profile.Name) {
+			errs = append(errs, field.Invalid(path.Child("name"), profile.Name, msg))
+		}
+		if names[profile.Name] {
+			errs = append(errs, field.Duplicate(path.Child("name"), profile.Name))
+		}
+		names[profile.Name] = true
+		// The sections not set in the profile are inherited from the default configuration.
+		if !unset(profile.NetPolConfig) {
+			errs = append(errs, validateNetPolConfig(profile.NetPolConfig, path.Child("networkPolicyConfig"))...)
+		}
+		if !unset(profile.QuotaConfig) {
+			errs = append(errs, validateQuotaConfig(profile.QuotaConfig, path.Child("quotaConfig"))...)
+		}
+		if !unset(profile.LimitRangeConfig) {
+			errs = append(errs, validateLimitRangeConfig(profile.LimitRangeConfig, path.Child("limitRangeConfig"))...)
+		}
+	}
+	return errs
+}
+
+// validateNetPolConfig checks the names of the policies and that their pod selectors are not empty.
+// An empty pod selector would isolate all the pods of the namespace and not only the hermetic builds.
+func validateNetPolConfig(config settingsv1alpha1.SettingsNetPolConfig, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if len(config.Policies) == 0 {
+		return validatePodSelector(config.Spec, path.Child("spec", "podSelector"))
+	}
+	names := map[string]bool{}
+	for i, policy := range config.Policies {
+		policyPath := path.Child("policies").Index(i)
+		for _, msg := range validation.IsDNS1123Subdomain(policy.Name) {
+			errs = append(errs, field.Invalid(policyPath.Child("name"), policy.Name, msg))
+		}
+		if names[policy.Name] {
+			errs = append(errs, field.Duplicate(policyPath.Child("name"), policy.Name))
+		}
+		names[policy.Name] = true
+		errs = append(errs, validatePodSelector(policy.Spec, policyPath.Child("spec", "podSelector"))...)
+	}
+	return errs
+}
+
+func validatePodSelector(spec netv1.NetworkPolicySpec, path *field.Path) field.ErrorList {
+	if len(spec.PodSelector.MatchLabels) == 0 && len(spec.PodSelector.MatchExpressions) == 0 {
+		return field.ErrorList{field.Required(path, "an empty pod selector would apply to all the pods of the namespace")}
+	}
+	return nil
+}
+
+// validateQuotaConfig checks the names of the quotas and their hard limits.
+func validateQuotaConfig(config settingsv1alpha1.SettingsQuotaConfig, path *field.Path) field.ErrorList {
+	if len(config.Quotas) == 0 {
+		return validateResourceList(config.Spec.Hard, path.Child("spec", "hard"))
+	}
+	var errs field.ErrorList
+	names := map[string]bool{}
+	for i, quota := range config.Quotas {
+		quotaPath := path.Child("quotas").Index(i)
+		for _, msg := range validation.IsDNS1123Subdomain(quota.Name) {
+			errs = append(errs, field.Invalid(quotaPath.Child("name"), quota.Name, msg))
+		}
+		if names[quota.Name] {
+			errs = append(errs, field.Duplicate(quotaPath.Child("name"), quota.Name))
+		}
+		names[quota.Name] = true
+		errs = append(errs, validateResourceList(quota.Spec.Hard, quotaPath.Child("spec", "hard"))...)
+	}
+	return errs
+}
+
+// validateLimitRangeConfig checks the limits of the LimitRange as the API server would when it gets applied:
+// the quantities are not negative and the default request, the default limit, the minimum and the maximum
+// of each resource are consistent.
+func validateLimitRangeConfig(config settingsv1alpha1.SettingsLimitRangeConfig, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for i, limit := range config.Spec.Limits {
+		limitPath := path.Child("spec", "limits").Index(i)
+		switch limit.Type {
+		case corev1.LimitTypeContainer, corev1.LimitTypePod, corev1.LimitTypePersistentVolumeClaim:
+		default:
+			errs = append(errs, field.NotSupported(limitPath.Child("type"), limit.Type,
+				[]string{string(corev1.LimitTypeContainer), string(corev1.LimitTypePod), string(corev1.LimitTypePersistentVolumeClaim)}))
+		}
+		if limit.Type == corev1.LimitTypePod {
+			if len(limit.Default) > 0 {
+				errs = append(errs, field.Forbidden(limitPath.Child("default"), "not supported when the limit type is Pod"))
+			}
+			if len(limit.DefaultRequest) > 0 {
+				errs = append(errs, field.Forbidden(limitPath.Child("defaultRequest"), "not supported when the limit type is Pod"))
+			}
+		}
+		errs = append(errs, validateResourceList(limit.Max, limitPath.Child("max"))...)
+		errs = append(errs, validateResourceList(limit.Min, limitPath.Child("min"))...)
+		errs = append(errs, validateResourceList(limit.Default, limitPath.Child("default"))...)
+		errs = append(errs, validateResourceList(limit.DefaultRequest, limitPath.Child("defaultRequest"))...)
+		for name, ratio := range limit.MaxLimitRequestRatio {
+			if ratio.Cmp(resource.MustParse("1")) < 0 {
+				errs = append(errs, field.Invalid(limitPath.Child("maxLimitRequestRatio").Key(string(name)), ratio.String(), "must be greater than or equal to 1"))
+			}
+		}
+
+		// Each value must not exceed the following ones: min <= defaultRequest <= default <= max.
+		bounds := []struct {
+			name   string
+			values corev1.ResourceList
+		}{{"min", limit.Min}, {"defaultRequest", limit.DefaultRequest}, {"default", limit.Default}, {"max", limit.Max}}
+		for j, lower := range bounds {
+			for name, quantity := range lower.values {
+				for _, upper := range bounds[j+1:] {
+					if bound, ok := upper.values[name]; ok && quantity.Cmp(bound) > 0 {
+						errs = append(errs, field.Invalid(limitPath.Child(lower.name).Key(string(name)), quantity.String(),
+							fmt.Sprintf("must be less than or equal to the %s value %s", upper.name, bound.String())))
+					}
+				}
+			}
+		}
+	}
+	return errs
+}
+
+// validateAllowedProfiles checks that each workspace is restricted once and that the allowed profiles are defined.
+func validateAllowedProfiles(config *settingsv1alpha1.SettingsConfig, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	var names []string
+	for _, profile := range config.Profiles {
+		names = append(names, profile.Name)
+	}
+	workspaces := map[string]bool{}
+	for i, allowed := range config.AllowedProfiles {
+		allowedPath := path.Index(i)
+		if allowed.Workspace == "" {
+			errs = append(errs, field.Required(allowedPath.Child("workspace"), "the logical cluster of the workspace is required"))
+		} else if workspaces[allowed.Workspace] {
+			errs = append(errs, field.Duplicate(allowedPath.Child("workspace"), allowed.Workspace))
+		}
+		workspaces[allowed.Workspace] = true
+
+		for j, name := range allowed.Profiles {
+			if !contains(names, name) {
+				errs = append(errs, field.NotSupported(allowedPath.Child("profiles").Index(j), name, names))
+			}
+		}
+	}
+	return errs
+}
+
+// validateQuotaOverrides checks that each workspace is overridden once and that the overrides
+// do not exceed the maxima set by the administrator.
+func validateQuotaOverrides(config *settingsv1alpha1.SettingsConfig, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	workspaces := map[string]bool{}
+	for i, override := range config.QuotaOverrides {
+		overridePath := path.Index(i)
+		if override.Workspace == "" {
+			errs = append(errs, field.Required(overridePath.Child("workspace"), "the logical cluster of the workspace is required"))
+		} else if workspaces[override.Workspace] {
+			errs = append(errs, field.Duplicate(overridePath.Child("workspace"), override.Workspace))
+		}
+		workspaces[override.Workspace] = true
+
+		hardPath := overridePath.Child("hard")
+		errs = append(errs, validateResourceList(override.Hard, hardPath)...)
+		if len(config.MaxQuotaOverrides) == 0 {
+			continue
+		}
+		for name, quantity := range override.Hard {
+			max, ok := config.MaxQuotaOverrides[name]
+			if !ok {
+				errs = append(errs, field.Forbidden(hardPath.Key(string(name)), "the resource cannot be overridden"))
+				continue
+			}
+			if quantity.Cmp(max) > 0 {
+				errs = append(errs, field.Invalid(hardPath.Key(string(name)), quantity.String(), fmt.Sprintf("must be less than or equal to %s", max.String())))
+			}
+		}
+	}
+	return errs
+}
+
+// validateQuotaThresholds checks that the thresholds are percentages and that the warning threshold
+// does not exceed the critical one.
+func validateQuotaThresholds(config settingsv1alpha1.SettingsQuotaThresholds, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	if config.Warning < 0 || config.Warning > 100 {
+		errs = append(errs, field.Invalid(path.Child("warning"), config.Warning, "must be between 0 and 100"))
+	}
+	if config.Critical < 0 || config.Critical > 100 {
+		errs = append(errs, field.Invalid(path.Child("critical"), config.Critical, "must be between 0 and 100"))
+	}
+	if warning, critical := quotaThresholds(config); warning > critical {
+		errs = append(errs, field.Invalid(path.Child("warning"), warning, fmt.Sprintf("must be less than or equal to the critical threshold %d", critical)))
+	}
+	return errs
+}
+
+// validateRollout checks the canary selector and the percentage of the rollout strategy.
+func validateRollout(strategy *settingsv1alpha1.SettingsRolloutStrategy, path *field.Path) field.ErrorList {
+	if strategy == nil {
+		return nil
+	}
+	var errs field.ErrorList
+	if strategy.CanarySelector != nil {
+		if _, err := metav1.LabelSelectorAsSelector(strategy.CanarySelector); err != nil {
+			errs = append(errs, field.Invalid(path.Child("canarySelector"), strategy.CanarySelector, err.Error()))
+		}
+	}
+	if strategy.Percentage != nil && (*strategy.Percentage < 0 || *strategy.Percentage > 100) {
+		errs = append(errs, field.Invalid(path.Child("percentage"), *strategy.Percentage, "must be between 0 and 100"))
+	}
+	return errs
+}
+
+// validateResourceList checks that the quantities are not negative.
+func validateResourceList(resources corev1.ResourceList, path *field.Path) field.ErrorList {
+	var errs field.ErrorList
+	for name, quantity := range resources {
+		if quantity.Sign() < 0 {
+			errs = append(errs, field.Invalid(path.Key(string(name)), quantity.String(), "must be greater than or equal to 0"))
+		}
+	}
+	return errs
+}
+
+// validateSettings returns the errors found in the Settings of a workspace according to the configuration:
+// the profile must be defined and allowed in the workspace.
+func validateSettings(config *settingsv1alpha1.SettingsConfig, workspace string, s *settingsv1alpha1.Settings) field.ErrorList {
+	var errs field.ErrorList
+
+	if s.Spec.Profile != "" {
+		var names []string
+		for _, profile := range config.Profiles {
+			names = append(names, profile.Name)
+		}
+		if allowed, restricted := allowedProfiles(config, workspace); restricted {
+			names = allowed
+		}
+		if !contains(names, s.Spec.Profile) {
+			errs = append(errs, field.NotSupported(field.NewPath("spec", "profile"), s.Spec.Profile, names))
+		}
+	}
+
+	return errs
+}
@@ -0,0 +1,241 @@
+package controllers
+
+import (
+	"context"
+	"testing"
+
+	"github.com/kcp-dev/logicalcluster/v2"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
+)
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		mutate func(*settingsv1alpha1.SettingsConfig)
+		// paths of the expected errors
+		errors []string
+	}{
+		{name: "valid", mutate: func(*settingsv1alpha1.SettingsConfig) {}},
+		{
+			name:   "missing namespace",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) { c.Namespace = "" },
+			errors: []string{"namespace"},
+		},
+		{
+			name:   "invalid namespace",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) { c.Namespace = "Pipelines" },
+			errors: []string{"namespace"},
+		},
+		{
+			name:   "unknown policies",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) { c.CleanupPolicy, c.NamespacePolicy = "Keep", "Take" },
+			errors: []string{"cleanupPolicy", "namespacePolicy"},
+		},
+		{
+			name:   "empty pod selector",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) { c.NetPolConfig.Spec.PodSelector = metav1.LabelSelector{} },
+			errors: []string{"networkPolicyConfig.spec.podSelector"},
+		},
+		{
+			name: "duplicated policies and quotas",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) {
+				c.NetPolConfig.Policies = []settingsv1alpha1.NamedNetworkPolicy{
+					{Name: "np", Spec: c.NetPolConfig.Spec}, {Name: "np", Spec: c.NetPolConfig.Spec},
+				}
+				c.QuotaConfig.Quotas = []settingsv1alpha1.NamedResourceQuota{
+					{Name: "qt", Spec: c.QuotaConfig.Spec}, {Name: "qt", Spec: c.QuotaConfig.Spec},
+				}
+			},
+			errors: []string{"networkPolicyConfig.policies[1].name", "quotaConfig.quotas[1].name"},
+		},
+		{
+			name: "negative quantities",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) {
+				c.QuotaConfig.Spec.Hard = resourceList("pods", "-1")
+				c.MaxQuotaOverrides = resourceList("pods", "-1")
+			},
+			errors: []string{"quotaConfig.spec.hard[pods]", "maxQuotaOverrides[pods]"},
+		},
+		{
+			name: "quota overrides",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) {
+				c.MaxQuotaOverrides = resourceList("count/pipelineruns.tekton.dev", "50")
+				c.QuotaOverrides = []settingsv1alpha1.SettingsQuotaOverride{
+					{Workspace: "root:org:a", Hard: resourceList("count/pipelineruns.tekton.dev", "50")},
+					{Workspace: "root:org:a"},
+					{Hard: resourceList("count/pipelineruns.tekton.dev", "60", "pods", "1")},
+					{Workspace: "root:org:b", Hard: resourceList("count/pipelineruns.tekton.dev", "-1")},
+				}
+			},
+			errors: []string{
+				"quotaOverrides[1].workspace",
+				"quotaOverrides[2].workspace",
+				"quotaOverrides[2].hard[count/pipelineruns.tekton.dev]",
+				"quotaOverrides[2].hard[pods]",
+				"quotaOverrides[3].hard[count/pipelineruns.tekton.dev]",
+			},
+		},
+		{
+			name: "thresholds out of range",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) {
+				c.QuotaThresholds = settingsv1alpha1.SettingsQuotaThresholds{Warning: -1, Critical: 101}
+			},
+			errors: []string{"quotaThresholds.warning", "quotaThresholds.critical"},
+		},
+		{
+			name:   "warning threshold above the default critical one",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) { c.QuotaThresholds.Warning = 98 },
+			errors: []string{"quotaThresholds.warning"},
+		},
+		{
+			name: "invalid rollout strategy",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) {
+				c.Rollout = &settingsv1alpha1.SettingsRolloutStrategy{
+					CanarySelector: &metav1.LabelSelector{MatchExpressions: []metav1.LabelSelectorRequirement{{Key: "canary", Operator: "Near"}}},
+					Percentage:     percentage(101),
+				}
+			},
+			errors: []string{"rollout.canarySelector", "rollout.percentage"},
+		},
+		{
+			name: "invalid limit range",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) {
+				c.LimitRangeConfig.Spec.Limits = []corev1.LimitRangeItem{
+					{
+						Type:           corev1.LimitTypeContainer,
+						Min:            resourceList("cpu", "200m"),
+						DefaultRequest: resourceList("cpu", "100m", "memory", "-1"),
+						Default:        resourceList("cpu", "1", "memory", "512Mi"),
+						Max:            resourceList("cpu", "500m", "memory", "1Gi"),
+					},
+					{Type: corev1.LimitTypePod, Default: resourceList("cpu", "1"), MaxLimitRequestRatio: resourceList("cpu", "500m")},
+					{Type: "Node"},
+				}
+			},
+			errors: []string{
+				"limitRangeConfig.spec.limits[0].min[cpu]",
+				"limitRangeConfig.spec.limits[0].defaultRequest[memory]",
+				"limitRangeConfig.spec.limits[0].default[cpu]",
+				"limitRangeConfig.spec.limits[1].default",
+				"limitRangeConfig.spec.limits[1].maxLimitRequestRatio[cpu]",
+				"limitRangeConfig.spec.limits[2].type",
+			},
+		},
+		{
+			name: "invalid profiles",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) {
+				c.Profiles = []settingsv1alpha1.SettingsProfile{
+					{Name: "small", NetPolConfig: settingsv1alpha1.SettingsNetPolConfig{Policies: []settingsv1alpha1.NamedNetworkPolicy{{Name: "np"}}}},
+					{Name: "small", QuotaConfig: settingsv1alpha1.SettingsQuotaConfig{Spec: corev1.ResourceQuotaSpec{Hard: resourceList("pods", "-1")}}},
+					{Name: "large", LimitRangeConfig: settingsv1alpha1.SettingsLimitRangeConfig{Spec: corev1.LimitRangeSpec{Limits: []corev1.LimitRangeItem{
+						{Type: corev1.LimitTypeContainer, Default: resourceList("memory", "2Gi"), Max: resourceList("memory", "1Gi")},
+					}}}},
+				}
+			},
+			errors: []string{
+				"profiles[0].networkPolicyConfig.policies[0].spec.podSelector",
+				"profiles[1].name",
+				// the network policy of the second profile is inherited from the default configuration
+				"profiles[1].quotaConfig.spec.hard[pods]",
+				"profiles[2].limitRangeConfig.spec.limits[0].default[memory]",
+			},
+		},
+		{
+			name: "allowed profiles",
+			mutate: func(c *settingsv1alpha1.SettingsConfig) {
+				c.Profiles = []settingsv1alpha1.SettingsProfile{{Name: "small"}}
+				c.AllowedProfiles = []settingsv1alpha1.SettingsAllowedProfiles{
+					{Workspace: "root:org:a", Profiles: []string{"small"}},
+					{Workspace: "root:org:a"},
+					{Profiles: []string{"small", "large"}},
+				}
+			},
+			errors: []string{
+				"allowedProfiles[1].workspace",
+				"allowedProfiles[2].workspace",
+				"allowedProfiles[2].profiles[1]",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := validConfig()
+			tt.mutate(&config)
+			errs := ValidateConfig(&config)
+			var paths []string
+			for _, err := range errs {
+				paths = append(paths, err.Field)
+			}
+			if !sameElements(paths, tt.errors) {
+				t.Errorf("ValidateConfig() errors on %v, expected %v: %v", paths, tt.errors, errs)
+			}
+		})
+	}
+}
+
+func TestValidateSettings(t *testing.T) {
+	config := validConfig()
+	config.Profiles = []settingsv1alpha1.SettingsProfile{{Name: "small"}, {Name: "enterprise"}}
+	config.AllowedProfiles = []settingsv1alpha1.SettingsAllowedProfiles{{Workspace: "root:org:free", Profiles: []string{"small"}}}
+
+	tests := []struct {
+		name      string
+		workspace string
+		profile   string
+		errors    []string
+	}{
+		{name: "default profile"},
+		{name: "defined profile", profile: "small"},
+		{name: "undefined profile", profile: "large", errors: []string{"spec.profile"}},
+		{name: "allowed profile", workspace: "root:org:free", profile: "small"},
+		{name: "profile not allowed", workspace: "root:org:free", profile: "enterprise", errors: []string{"spec.profile"}},
+		{name: "default profile in a restricted workspace", workspace: "root:org:free"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &settingsv1alpha1.Settings{Spec: settingsv1alpha1.SettingsSpec{Profile: tt.profile}}
+			var paths []string
+			for _, err := range validateSettings(&config, tt.workspace, s) {
+				paths = append(paths, err.Field)
+			}
+			if !sameElements(paths, tt.errors) {
+				t.Errorf("validateSettings() errors on %v, expected %v", paths, tt.errors)
+			}
+		})
+	}
+}
+
+func TestSettingsValidator(t *testing.T) {
+	config := validConfig()
+	config.Profiles = []settingsv1alpha1.SettingsProfile{{Name: "small"}}
+	config.AllowedProfiles = []settingsv1alpha1.SettingsAllowedProfiles{{Workspace: "root:org:free"}}
+	v := &SettingsValidator{CtrlConfig: NewConfigStore(config)}
+	ctx := context.Background()
+
+	valid := &settingsv1alpha1.Settings{ObjectMeta: metav1.ObjectMeta{Name: SettingName}}
+	if err := v.ValidateCreate(ctx, valid); err != nil {
+		t.Errorf("ValidateCreate() rejected valid Settings: %v", err)
+	}
+	invalid := valid.DeepCopy()
+	invalid.Spec.Profile = "large"
+	if err := v.ValidateUpdate(ctx, valid, invalid); !errors.IsInvalid(err) {
+		t.Errorf("ValidateUpdate() error = %v, expected an invalid error", err)
+	}
+	// The workspace is identified through the logical cluster of the Settings.
+	small := valid.DeepCopy()
+	small.Spec.Profile = "small"
+	if err := v.ValidateCreate(ctx, small); err != nil {
+		t.Errorf("ValidateCreate() rejected an allowed profile: %v", err)
+	}
+	small.Annotations = map[string]string{logicalcluster.AnnotationKey: "root:org:free"}
+	if err := v.ValidateCreate(ctx, small); !errors.IsInvalid(err) {
+		t.Errorf("ValidateCreate() error = %v, expected an invalid error for a profile not allowed in the workspace", err)
+	}
+	if err := v.ValidateDelete(ctx, invalid); err != nil {
+		t.Errorf("ValidateDelete() rejected the deletion: %v", err)
+	}
+}
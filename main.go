@@ -5,12 +5,14 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/kcp-dev/logicalcluster/v2"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/types"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
-	"k8s.io/client-go/rest"
 	"k8s.io/klog/v2"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 
@@ -19,7 +21,6 @@ import (
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/healthz"
-	"sigs.k8s.io/controller-runtime/pkg/kcp"
 	"sigs.k8s.io/controller-runtime/pkg/log/zap"
 
 	settingsv1alpha1 "github.com/fgiloux/settings-controller/api/v1alpha1"
@@ -53,12 +54,22 @@ func main() {
 	var probeAddr string
 	var apiExportName string
 	var apiExportWs string
+	var exports exportFlags
+	var vwResyncPeriod time.Duration
+	var identityBinding string
+	var validateConfig bool
 	// The file configuration takes precedence over the flags and their default values.
 	flag.StringVar(&configFile, "config", "config/manager/controller_manager_config.yaml", "The controller will load its initial configuration from this file. "+
 		"Omit this flag to use the default configuration values. "+
 		"Command-line flags override configuration from this file.")
+	flag.BoolVar(&validateConfig, "validate-config", false, "Validate the configuration file and exit.")
 	flag.StringVar(&apiExportName, "api-export-name", "settings-configuration.pipeline-service.io", "The name of the APIExport.")
-	flag.StringVar(&apiExportWs, "api-export-workspace", "", "The workspace containing the APIExport.")
+	flag.StringVar(&apiExportWs, "api-export-workspace", "", "The workspace containing the APIExport. "+
+		"It is derived from the logical cluster of the APIExport if not set.")
+	flag.Var(&exports, "api-export", "An APIExport served by the controller with the file of its settings configuration, as name=path. "+
+		"It can be repeated to serve several APIExports. If not set, the APIExport named by --api-export-name is served with the configuration of --config.")
+	flag.StringVar(&identityBinding, "identity-apibinding", "kubernetes", "The APIBinding providing the identity hashes of the claimed resources, networkpolicies for instance.")
+	flag.DurationVar(&vwResyncPeriod, "virtual-workspaces-resync-period", 30*time.Second, "The interval at which the virtual workspace URLs of the APIExport are checked for shards being added or removed.")
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metric endpoint binds to.")
 	flag.StringVar(&probeAddr, "health-probe-bind-address", ":8081", "The address the probe endpoint binds to.")
 	flag.BoolVar(&enableLeaderElection, "leader-elect", false,
@@ -76,12 +87,26 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&logOpts)))
 
+	if len(exports) == 0 {
+		exports = exportFlags{{name: apiExportName, configFile: configFile}}
+	}
+
+	// The configuration files are checked without connecting to kcp, before they get rolled out for instance.
+	if validateConfig {
+		for _, export := range exports {
+			if _, err := loadSettingsConfig(export.configFile); err != nil {
+				setupLog.Error(err, "invalid configuration", "path", export.configFile)
+				os.Exit(1)
+			}
+			setupLog.Info("valid configuration", "path", export.configFile)
+		}
+		return
+	}
+
 	ctx := ctrl.SetupSignalHandler()
 
 	restConfig := ctrl.GetConfigOrDie()
 
-	setupLog = setupLog.WithValues("api-export-name", apiExportName)
-
 	/*if err := apisv1alpha1.AddToScheme(scheme); err != nil {
 		setupLog.Error(err, "error adding apis.kcp.dev/v1alpha1 to scheme")
 		os.Exit(1)
@@ -89,7 +114,6 @@ func main() {
 
 	var mgr ctrl.Manager
 	var err error
-	ctrlConfig := settingsv1alpha1.SettingsConfig{}
 	options := ctrl.Options{
 		Scheme:             scheme,
 		MetricsBindAddress: metricsAddr,
@@ -101,40 +125,144 @@ func main() {
 		LeaderElectionConfig:    restConfig,
 	}
 
+	// The generic configuration of the manager is taken from the --config file,
+	// the settings from the configuration file of each APIExport.
 	if configFile != "" {
-		options, err = options.AndFrom(ctrl.ConfigFile().AtPath(configFile).OfKind(&ctrlConfig))
+		options, err = options.AndFrom(ctrl.ConfigFile().AtPath(configFile).OfKind(&settingsv1alpha1.SettingsConfig{}))
 		if err != nil {
 			setupLog.Error(err, "unable to load the config file")
 			os.Exit(1)
 		}
 	}
 
-	setupLog.V(1).Info("Looking up virtual workspace URL")
-	cfg, err := restConfigForAPIExport(ctx, restConfig, apiExportName)
+	setupClient, err := client.New(restConfig, client.Options{Scheme: scheme})
 	if err != nil {
-		setupLog.Error(err, "error looking up virtual workspace URL")
+		setupLog.Error(err, "error creating setup client")
 		os.Exit(1)
 	}
 
-	setupLog.Info("Using virtual workspace URL", "url", cfg.Host)
+	var served []servedExport
+	for _, export := range exports {
+		exportLog := setupLog.WithValues("api-export-name", export.name)
+
+		ctrlConfig, err := loadSettingsConfig(export.configFile)
+		if err != nil {
+			exportLog.Error(err, "invalid configuration", "path", export.configFile)
+			os.Exit(1)
+		}
 
-	options.LeaderElectionConfig = restConfig
-	mgr, err = kcp.NewClusterAwareManager(cfg, options)
+		exportLog.V(1).Info("Looking up APIExport")
+		apiExport, err := lookupAPIExport(ctx, setupClient, export.name)
+		if err != nil {
+			exportLog.Error(err, "error looking up APIExport")
+			os.Exit(1)
+		}
+		exportLog = setupLog.WithValues("api-export-name", apiExport.Name)
+		// The APIBindings are matched on the identity of the APIExport, which is set once the APIExport is ready.
+		if apiExport.Status.IdentityHash == "" {
+			exportLog.Error(fmt.Errorf("the identity of APIExport %q is not set", apiExport.Name), "APIExport not ready")
+			os.Exit(1)
+		}
+		// The workspace of the APIExports is the one the controller is connected to. A workspace set explicitly,
+		// which points to another logical cluster, is more likely a configuration mistake than intended.
+		exportCluster := logicalcluster.From(apiExport)
+		if apiExportWs == "" {
+			apiExportWs = exportCluster.String()
+		} else if apiExportWs != exportCluster.String() {
+			exportLog.Error(fmt.Errorf("--api-export-workspace is %q but APIExport %q is in workspace %q", apiExportWs, apiExport.Name, exportCluster),
+				"mismatched APIExport workspace, check the kubeconfig context or remove the flag")
+			os.Exit(1)
+		}
+		exportLog.Info("APIExport found", "workspace", apiExportWs, "identity", apiExport.Status.IdentityHash)
+		served = append(served, servedExport{apiExport: apiExport, configFile: export.configFile, config: ctrlConfig})
+	}
+
+	setupLog.V(1).Info("Looking up identity hashes", "apibinding", identityBinding)
+	var claims []apisv1alpha1.PermissionClaim
+	for _, export := range served {
+		claims = append(claims, export.apiExport.Spec.PermissionClaims...)
+	}
+	hashes, err := controllers.IdentityHashes(ctx, setupClient, identityBinding, claims)
 	if err != nil {
-		setupLog.Error(err, "unable to start cluster aware manager")
+		setupLog.Error(err, "error looking up identity hashes")
 		os.Exit(1)
 	}
+	// The setup subcommand sets the identity hashes on the permission claims of the APIExports and exits.
+	if flag.Arg(0) == "setup" {
+		for _, export := range served {
+			if err := controllers.PatchPermissionClaims(ctx, setupClient, export.apiExport, hashes); err != nil {
+				setupLog.Error(err, "error setting identity hashes", "api-export-name", export.apiExport.Name)
+				os.Exit(1)
+			}
+		}
+		setupLog.Info("identity hashes of the permission claims set")
+		return
+	}
+	for _, export := range served {
+		if err := controllers.VerifyPermissionClaims(export.apiExport, hashes); err != nil {
+			setupLog.Error(err, "refusing to start, the identity hashes can be set with the setup subcommand", "api-export-name", export.apiExport.Name)
+			os.Exit(1)
+		}
+	}
 
-	if err = (&controllers.SettingsReconciler{
-		Client:          mgr.GetClient(),
-		Scheme:          mgr.GetScheme(),
-		CtrlConfig:      ctrlConfig,
-		ExportWorkspace: apiExportWs,
-		ExportName:      apiExportName,
-	}).SetupWithManager(mgr); err != nil {
-		setupLog.Error(err, "unable to create controller", "controller", "Settings")
+	// The main manager, connected to the workspace of the APIExports, handles leader election,
+	// metrics and health probes. The controllers run in a manager per APIExport and virtual workspace URL,
+	// each with its own cache.
+	mgr, err = ctrl.NewManager(restConfig, options)
+	if err != nil {
+		setupLog.Error(err, "unable to start manager")
 		os.Exit(1)
 	}
+
+	for _, export := range served {
+		exportName := export.apiExport.Name
+		identityHash := export.apiExport.Status.IdentityHash
+		configStore := controllers.NewConfigStore(export.config)
+		shardManager := &controllers.ShardManager{
+			Client:     mgr.GetAPIReader(),
+			ExportName: exportName,
+			RestConfig: restConfig,
+			Scheme:     scheme,
+			NewReconciler: func(shardMgr ctrl.Manager) *controllers.SettingsReconciler {
+				return &controllers.SettingsReconciler{
+					Client:             shardMgr.GetClient(),
+					Scheme:             shardMgr.GetScheme(),
+					CtrlConfig:         configStore,
+					ExportName:         exportName,
+					ExportIdentityHash: identityHash,
+				}
+			},
+			Interval: vwResyncPeriod,
+		}
+		if err = mgr.Add(shardManager); err != nil {
+			setupLog.Error(err, "unable to set up the shard manager", "api-export-name", exportName)
+			os.Exit(1)
+		}
+
+		// The webhook server requires certificates, it is enabled through the environment as in the deployment manifests.
+		// The Settings of the different APIExports cannot be told apart, it is only supported with a single APIExport.
+		if os.Getenv("ENABLE_WEBHOOKS") == "true" {
+			if len(served) > 1 {
+				setupLog.Info("the Settings webhook is not supported with several APIExports, skipping")
+			} else if err = (&controllers.SettingsValidator{CtrlConfig: configStore}).SetupWebhookWithManager(mgr); err != nil {
+				setupLog.Error(err, "unable to create webhook", "webhook", "Settings")
+				os.Exit(1)
+			}
+		}
+
+		if export.configFile != "" {
+			// Changes to the configuration file are rolled out to all workspaces without restart.
+			if err := mgr.Add(&controllers.ConfigWatcher{
+				Path:     export.configFile,
+				Scheme:   scheme,
+				Store:    configStore,
+				OnChange: shardManager.EnqueueAll,
+			}); err != nil {
+				setupLog.Error(err, "unable to set up the configuration watcher", "api-export-name", exportName)
+				os.Exit(1)
+			}
+		}
+	}
 	// +kubebuilder:scaffold:builder
 
 	if err := mgr.AddHealthzCheck("healthz", healthz.Ping); err != nil {
@@ -154,22 +282,69 @@ func main() {
 	}
 }
 
-// +kubebuilder:rbac:groups="apis.kcp.dev",resources=apiexports,verbs=get;list;watch
+// exportFlag is an APIExport served by the controller with the file of its settings configuration.
+type exportFlag struct {
+	name       string
+	configFile string
+}
 
-// restConfigForAPIExport returns a *rest.Config properly configured to communicate with the endpoint for the
-// APIExport's virtual workspace.
-func restConfigForAPIExport(ctx context.Context, cfg *rest.Config, apiExportName string) (*rest.Config, error) {
+// exportFlags implements flag.Value for the repeatable --api-export flag.
+type exportFlags []exportFlag
 
-	scheme := runtime.NewScheme()
-	if err := apisv1alpha1.AddToScheme(scheme); err != nil {
-		return nil, fmt.Errorf("error adding apis.kcp.dev/v1alpha1 to scheme: %w", err)
+func (e *exportFlags) String() string {
+	var values []string
+	for _, export := range *e {
+		values = append(values, export.name+"="+export.configFile)
 	}
+	return strings.Join(values, ",")
+}
 
-	apiExportClient, err := client.New(cfg, client.Options{Scheme: scheme})
-	if err != nil {
-		return nil, fmt.Errorf("error creating APIExport client: %w", err)
+func (e *exportFlags) Set(value string) error {
+	name, configFile, ok := strings.Cut(value, "=")
+	if !ok || name == "" || configFile == "" {
+		return fmt.Errorf("%q is not of the form name=path", value)
+	}
+	for _, export := range *e {
+		if export.name == name {
+			return fmt.Errorf("APIExport %q is set more than once", name)
+		}
 	}
+	*e = append(*e, exportFlag{name: name, configFile: configFile})
+	return nil
+}
+
+// servedExport is an APIExport served by the controller with its settings configuration.
+type servedExport struct {
+	apiExport  *apisv1alpha1.APIExport
+	configFile string
+	config     settingsv1alpha1.SettingsConfig
+}
 
+// loadSettingsConfig loads and validates the settings configuration file.
+// An empty configuration is returned when no file is specified.
+func loadSettingsConfig(path string) (settingsv1alpha1.SettingsConfig, error) {
+	config := settingsv1alpha1.SettingsConfig{}
+	if path == "" {
+		return config, nil
+	}
+	loader := ctrl.ConfigFile().AtPath(path).OfKind(&config)
+	if err := loader.InjectScheme(scheme); err != nil {
+		return config, err
+	}
+	if _, err := loader.Complete(); err != nil {
+		return config, err
+	}
+	if errs := controllers.ValidateConfig(&config); len(errs) > 0 {
+		return config, errs.ToAggregate()
+	}
+	return config, nil
+}
+
+// +kubebuilder:rbac:groups="apis.kcp.dev",resources=apiexports,verbs=get;list;watch;patch
+
+// lookupAPIExport returns the APIExport with the provided name or the only APIExport
+// of the workspace if the name is empty.
+func lookupAPIExport(ctx context.Context, apiExportClient client.Client, apiExportName string) (*apisv1alpha1.APIExport, error) {
 	var apiExport apisv1alpha1.APIExport
 
 	if apiExportName != "" {
@@ -191,13 +366,5 @@ func restConfigForAPIExport(ctx context.Context, cfg *rest.Config, apiExportName
 		apiExport = exports.Items[0]
 	}
 
-	if len(apiExport.Status.VirtualWorkspaces) < 1 {
-		return nil, fmt.Errorf("APIExport %q status.virtualWorkspaces is empty", apiExportName)
-	}
-
-	cfg = rest.CopyConfig(cfg)
-	// TODO(ncdc): sharding support
-	cfg.Host = apiExport.Status.VirtualWorkspaces[0].URL
-
-	return cfg, nil
+	return &apiExport, nil
 }
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExportFlagsSet(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  []string
+		exports exportFlags
+		err     bool
+	}{
+		{
+			name:    "single export",
+			values:  []string{"settings=/config/settings.yaml"},
+			exports: exportFlags{{name: "settings", configFile: "/config/settings.yaml"}},
+		},
+		{
+			name:   "several exports",
+			values: []string{"staging=/config/staging.yaml", "production=/config/production.yaml"},
+			exports: exportFlags{
+				{name: "staging", configFile: "/config/staging.yaml"},
+				{name: "production", configFile: "/config/production.yaml"},
+			},
+		},
+		{
+			name:    "equal sign in the path",
+			values:  []string{"settings=/config/a=b.yaml"},
+			exports: exportFlags{{name: "settings", configFile: "/config/a=b.yaml"}},
+		},
+		{name: "missing path", values: []string{"settings"}, err: true},
+		{name: "empty path", values: []string{"settings="}, err: true},
+		{name: "empty name", values: []string{"=/config/settings.yaml"}, err: true},
+		{name: "duplicated export", values: []string{"settings=/config/a.yaml", "settings=/config/b.yaml"}, err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var exports exportFlags
+			var err error
+			for _, value := range tt.values {
+				if err = exports.Set(value); err != nil {
+					break
+				}
+			}
+			if (err != nil) != tt.err {
+				t.Fatalf("Set() error = %v, expected an error: %t", err, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(exports, tt.exports) {
+				t.Errorf("Set() = %+v, expected %+v", exports, tt.exports)
+			}
+		})
+	}
+}
+
+func TestLoadSettingsConfig(t *testing.T) {
+	tests := []struct {
+		name string
+		path string
+		err  bool
+	}{
+		{name: "no file"},
+		{name: "sample", path: "config/samples/configuration_v1alpha1_settingsconfig.yaml"},
+		{name: "missing file", path: "config/samples/missing.yaml", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := loadSettingsConfig(tt.path); (err != nil) != tt.err {
+				t.Errorf("loadSettingsConfig() error = %v, expected an error: %t", err, tt.err)
+			}
+		})
+	}
+}